@@ -0,0 +1,328 @@
+package rapidnet
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotConnected 未连接且不缓存待发送数据
+	ErrNotConnected = errors.New("rapidnet: not connected")
+
+	// ErrPendingFull 断开期间缓存的待发送数据已满
+	ErrPendingFull = errors.New("rapidnet: pending buffer is full")
+
+	// ErrClientClosed 客户端已关闭
+	ErrClientClosed = errors.New("rapidnet: client closed")
+)
+
+// ReconnectOptions 自动重连的参数
+type ReconnectOptions struct {
+	// Config 连接使用的配置, 为nil时使用全局配置
+	Config *Config
+
+	// TLSConfig 不为nil时使用TLS连接
+	TLSConfig *tls.Config
+
+	// Dial 不为nil时使用Dial建立连接, 忽略address、TLSConfig及DialTimeout, 可用于Unix socket等传输层
+	Dial func() (net.Conn, error)
+
+	// DialTimeout 连接的超时时间(毫秒), 为0时使用5000
+	DialTimeout uint32
+
+	// MinBackoff 第一次重连前的等待时间, 为0时使用100ms
+	MinBackoff time.Duration
+
+	// MaxBackoff 重连等待时间的上限, 每次失败后等待时间加倍, 为0时使用30s
+	MaxBackoff time.Duration
+
+	// Jitter 等待时间随机浮动的比例, 取值[0, 1], 超出范围时取最近的边界
+	Jitter float64
+
+	// MaxPending 断开期间最多缓存的待发送数据数量, 重连后依次发送. 为0时不缓存
+	MaxPending int
+}
+
+// ReconnectingClient 断开后自动重连的客户端.
+// 调用方始终使用同一个ReconnectingClient发送数据及读取事件和数据, 不需要关心底层连接的变化.
+type ReconnectingClient struct {
+	address string
+	opts    ReconnectOptions
+
+	mutex   sync.Mutex
+	conn    *Connection // 当前连接, 断开时为nil
+	pending [][]byte    // 断开期间缓存的待发送数据
+
+	eventChan       chan *Event
+	receiveDataChan chan []byte
+
+	closeChan chan struct{}
+	closeOnce sync.Once
+	exitChan  chan struct{}
+}
+
+// CreateReconnectingClient 创建自动重连的客户端, 调用Start后开始连接
+func CreateReconnectingClient(address string, opts ReconnectOptions) *ReconnectingClient {
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 5000
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Millisecond * 100
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = time.Second * 30
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = opts.MinBackoff
+	}
+	if opts.Jitter < 0 {
+		opts.Jitter = 0
+	} else if opts.Jitter > 1 {
+		opts.Jitter = 1
+	}
+
+	return &ReconnectingClient{
+		address:         address,
+		opts:            opts,
+		eventChan:       make(chan *Event, 16),
+		receiveDataChan: make(chan []byte, 16),
+		closeChan:       make(chan struct{}),
+		exitChan:        make(chan struct{}),
+	}
+}
+
+// Start 开始连接, 返回事件chan. 连接失败或断开后, 发送EventReconnecting并按退避时间重连,
+// 连接成功后发送EventConnected. Close后事件chan被关闭
+func (c *ReconnectingClient) Start() <-chan *Event {
+	go c.loop()
+	return c.eventChan
+}
+
+// ReceiveDataChan 返回所有连接收到的数据, Close后被关闭
+func (c *ReconnectingClient) ReceiveDataChan() <-chan []byte {
+	return c.receiveDataChan
+}
+
+// Connection 返回当前的连接, 未连接时返回nil
+func (c *ReconnectingClient) Connection() *Connection {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conn
+}
+
+// Send 发送数据. 未连接(包括连接已断开但还没有通知EventDisconnected)时缓存数据, 重连后发送
+func (c *ReconnectingClient) Send(data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.closeChan:
+		return ErrClientClosed
+	default:
+	}
+
+	if c.conn != nil {
+		if err := c.conn.Send(data); err != ErrConnClosed {
+			return err
+		}
+	}
+
+	if c.opts.MaxPending == 0 {
+		return ErrNotConnected
+	}
+	if len(c.pending) >= c.opts.MaxPending {
+		return ErrPendingFull
+	}
+	c.pending = append(c.pending, data)
+	return nil
+}
+
+// Close 断开连接并停止重连
+func (c *ReconnectingClient) Close() {
+	c.closeOnce.Do(func() { close(c.closeChan) })
+	<-c.exitChan
+}
+
+func (c *ReconnectingClient) loop() {
+	defer close(c.exitChan)
+	defer close(c.receiveDataChan)
+	defer close(c.eventChan)
+
+	attempt := 0
+	for {
+		var err error
+		if c.connect(&err) {
+			attempt = 0
+		}
+
+		select {
+		case <-c.closeChan:
+			return
+		default:
+		}
+
+		attempt++
+		if !c.emit(&Event{Type: EventReconnecting, Err: err}) || !c.sleep(c.backoff(attempt)) {
+			return
+		}
+	}
+}
+
+// connect 建立连接并处理事件, 直到连接断开. 成功建立过连接时返回true, err为断开或连接失败的原因
+func (c *ReconnectingClient) connect(err *error) bool {
+	client := CreateTCPClientWithConfig(c.opts.Config)
+
+	var conn *Connection
+	var events <-chan *Event
+	switch {
+	case c.opts.Dial != nil:
+		conn, events, *err = client.ConnectWith(c.opts.Dial)
+	case c.opts.TLSConfig != nil:
+		conn, events, *err = client.ConnectTLS(c.address, c.opts.DialTimeout, c.opts.TLSConfig)
+	default:
+		conn, events, *err = client.Connect(c.address, c.opts.DialTimeout)
+	}
+	if *err != nil {
+		return false
+	}
+
+	dataChan := conn.ReceiveDataChan()
+	for {
+		select {
+		case <-c.closeChan:
+			conn.Disconnect()
+			c.setConnection(nil)
+			return true
+
+		case data, ok := <-dataChan:
+			if !ok {
+				dataChan = nil
+				break
+			}
+			select {
+			case c.receiveDataChan <- data:
+			case <-c.closeChan:
+			}
+
+		case event := <-events:
+			switch event.Type {
+			case EventConnected:
+				c.setConnection(conn)
+			case EventDisconnected:
+				c.setConnection(nil)
+				*err = event.Err
+				// 数据chan中可能还有断开前收到的数据
+				c.drain(dataChan)
+			}
+
+			if !c.emit(event) {
+				conn.Disconnect()
+				c.setConnection(nil)
+				return true
+			}
+			if event.Type == EventDisconnected {
+				return true
+			}
+		}
+	}
+}
+
+// setConnection 设置当前连接, 先按顺序发送断开期间缓存的数据. 发送队列已满时等待,
+// 等待时不持有锁, 期间Send的数据继续缓存在之后. 连接断开或客户端关闭时未发送的数据继续缓存, 在下一个连接上发送
+func (c *ReconnectingClient) setConnection(conn *Connection) {
+	c.mutex.Lock()
+	c.conn = nil
+	if conn == nil || len(c.pending) == 0 {
+		c.conn = conn
+		c.mutex.Unlock()
+		return
+	}
+	c.mutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closeChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		c.mutex.Lock()
+		if len(c.pending) == 0 {
+			c.pending = nil
+			c.conn = conn
+			c.mutex.Unlock()
+			return
+		}
+		data := c.pending[0]
+		c.mutex.Unlock()
+
+		// 发送成功后才从缓存中移除
+		if conn.SendContext(ctx, data) != nil {
+			return
+		}
+		c.mutex.Lock()
+		c.pending = c.pending[1:]
+		c.mutex.Unlock()
+	}
+}
+
+// drain 转发dataChan中剩余的数据, 直到dataChan被关闭
+func (c *ReconnectingClient) drain(dataChan <-chan []byte) {
+	if dataChan == nil {
+		return
+	}
+	for data := range dataChan {
+		select {
+		case c.receiveDataChan <- data:
+		case <-c.closeChan:
+		}
+	}
+}
+
+// emit 发送事件, 客户端关闭时返回false
+func (c *ReconnectingClient) emit(event *Event) bool {
+	select {
+	case c.eventChan <- event:
+		return true
+	case <-c.closeChan:
+		return false
+	}
+}
+
+// sleep 等待d, 客户端关闭时返回false
+func (c *ReconnectingClient) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-c.closeChan:
+		return false
+	}
+}
+
+// backoff 返回第attempt次重连前的等待时间
+func (c *ReconnectingClient) backoff(attempt int) time.Duration {
+	d := c.opts.MinBackoff
+	for i := 1; i < attempt && d < c.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.opts.MaxBackoff {
+		d = c.opts.MaxBackoff
+	}
+
+	if c.opts.Jitter > 0 {
+		d += time.Duration(float64(d) * c.opts.Jitter * (rand.Float64()*2 - 1))
+	}
+	return d
+}
@@ -0,0 +1,184 @@
+package rapidnet
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnectingClient(t *testing.T) {
+	server := CreateTCPServer()
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := server.Addr().String()
+
+	client := CreateReconnectingClient(address, ReconnectOptions{
+		MinBackoff: time.Millisecond * 10,
+		MaxBackoff: time.Millisecond * 50,
+		MaxPending: 4,
+	})
+	clientEvents := client.Start()
+	defer client.Close()
+
+	waitEvent(t, clientEvents, EventConnected)
+	serverConn := waitEvent(t, serverEvents, EventConnected).Conn
+
+	// 服务器关闭后, 断开期间发送的数据被缓存
+	server.Stop()
+	serverConn.Disconnect()
+	waitEvent(t, clientEvents, EventDisconnected)
+	if err := client.Send([]byte("pending")); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, clientEvents, EventReconnecting)
+
+	server = CreateTCPServer()
+	serverEvents, err = server.Start(address, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	waitEvent(t, clientEvents, EventConnected)
+	serverConn = waitEvent(t, serverEvents, EventConnected).Conn
+	if data := <-serverConn.ReceiveDataChan(); string(data) != "pending" {
+		t.Fatal("unexpected data:", data)
+	}
+
+	serverConn.Send([]byte("hello"))
+	if data := <-client.ReceiveDataChan(); string(data) != "hello" {
+		t.Fatal("unexpected data:", data)
+	}
+}
+
+func TestReconnectingClient_PendingAndDrain(t *testing.T) {
+	server := CreateTCPServerWithConfig(&Config{SendQueueSize: 64})
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := server.Addr().String()
+	server.Stop()
+
+	// 缓存的数据多于发送队列的长度
+	const count = 32
+	client := CreateReconnectingClient(address, ReconnectOptions{
+		Config:     &Config{SendQueueSize: 4},
+		MinBackoff: time.Millisecond * 10,
+		MaxBackoff: time.Millisecond * 50,
+		MaxPending: count,
+	})
+	clientEvents := client.Start()
+	defer client.Close()
+
+	waitEvent(t, clientEvents, EventReconnecting)
+	for i := 0; i < count; i++ {
+		if err := client.Send([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server = CreateTCPServerWithConfig(&Config{SendQueueSize: 64})
+	serverEvents, err = server.Start(address, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	serverConn := waitEvent(t, serverEvents, EventConnected).Conn
+	for i := 0; i < count; i++ {
+		if data := <-serverConn.ReceiveDataChan(); len(data) != 1 || data[0] != byte(i) {
+			t.Fatal("unexpected data:", data)
+		}
+	}
+
+	// 断开前收到的数据在断开后仍然可以读取
+	waitEvent(t, clientEvents, EventConnected)
+	for i := 0; i < 8; i++ {
+		serverConn.Send([]byte{byte(i)})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	waitEvent(t, clientEvents, EventDisconnected)
+	for i := 0; i < 8; i++ {
+		if data := <-client.ReceiveDataChan(); len(data) != 1 || data[0] != byte(i) {
+			t.Fatal("unexpected data:", data)
+		}
+	}
+}
+
+func TestReconnectingClient_SetConnection(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	cfg := &Config{SendQueueSize: 2}
+	conn := &Connection{conn: c1, eventChan: make(chan *Event, 4), release: func() {}}
+	conn.init(cfg)
+	conn.packetHandler = cfg.newPacketHandler(c1)
+	go conn.loop()
+
+	client := CreateReconnectingClient("", ReconnectOptions{MaxPending: 16, Jitter: 5})
+	for i := 0; i < 8; i++ {
+		client.pending = append(client.pending, []byte{byte(i)})
+	}
+
+	// 对端不读取数据, 重新发送缓存的数据时阻塞, 期间Send及Connection不会阻塞
+	done := make(chan struct{})
+	go func() {
+		client.setConnection(conn)
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- client.Send([]byte{8})
+		client.Connection()
+	}()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send blocked during replay")
+	}
+
+	receiver := NewLengthFieldPacketHandler(c2, DefaultLengthFieldSpec)
+	for i := 0; i < 9; i++ {
+		var data []byte
+		var err error
+		for data == nil && err == nil {
+			data, err = receiver.Receive()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 1 || data[0] != byte(i) {
+			t.Fatal("unexpected data:", data)
+		}
+	}
+	<-done
+	if client.Connection() != conn {
+		t.Fatal("expect connection set after replay")
+	}
+
+	// 连接已断开但还没有收到断开事件时缓存数据
+	conn.Disconnect()
+	if err := client.Send([]byte{9}); err != nil {
+		t.Fatal("expect data cached, got", err)
+	}
+	if len(client.pending) != 1 {
+		t.Fatal("expect 1 pending, got", len(client.pending))
+	}
+
+	// Jitter限制在[0, 1], 等待时间不会为负数
+	for i := 1; i < 100; i++ {
+		if d := client.backoff(i); d < 0 {
+			t.Fatal("negative backoff:", d)
+		}
+	}
+}
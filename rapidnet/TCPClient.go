@@ -1,12 +1,15 @@
 package rapidnet
 
 import (
+	"crypto/tls"
 	"net"
 	"time"
 )
 
 // TCPClient type
 type TCPClient struct {
+	config *Config // 为nil时使用全局配置
+
 	conn *Connection // 与服务端的连接
 
 	readBuffer []byte // 读取数据缓存
@@ -16,27 +19,59 @@ type TCPClient struct {
 
 // Connect function
 func (c *TCPClient) Connect(serverAddress string, timeout uint32) (*Connection, <-chan *Event, error) {
+	dailer := newDialer(timeout)
 
-	dailer := net.Dialer{
-		Timeout:   time.Millisecond * time.Duration(timeout),
-		Deadline:  time.Time{},
-		KeepAlive: time.Second * time.Duration(30),
+	conn, err := dailer.Dial("tcp", serverAddress)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	conn, err := dailer.Dial("tcp", serverAddress)
+	return c.ConnectConn(conn)
+}
+
+// ConnectTLS 使用TLS连接服务器, timeout(毫秒)包括建立连接及握手的时间
+func (c *TCPClient) ConnectTLS(serverAddress string, timeout uint32, tlsConfig *tls.Config) (*Connection, <-chan *Event, error) {
+	dailer := newDialer(timeout)
+
+	conn, err := tls.DialWithDialer(dailer, "tcp", serverAddress, tlsConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c.ConnectConn(conn)
+}
+
+// ConnectWith 使用dial建立连接, 可用于Unix socket等非TCP的传输层, 例如
+//
+//	client.ConnectWith(func() (net.Conn, error) { return net.Dial("unix", path) })
+func (c *TCPClient) ConnectWith(dial func() (net.Conn, error)) (*Connection, <-chan *Event, error) {
+	conn, err := dial()
 	if err != nil {
 		return nil, nil, err
 	}
+
+	return c.ConnectConn(conn)
+}
+
+func newDialer(timeout uint32) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   time.Millisecond * time.Duration(timeout),
+		Deadline:  time.Time{},
+		KeepAlive: time.Second * time.Duration(30),
+	}
+}
+
+// ConnectConn 使用已建立的连接, 可用于非TCP的传输层(例如websocket)
+func (c *TCPClient) ConnectConn(conn net.Conn) (*Connection, <-chan *Event, error) {
 	c.eventChan = make(chan *Event, 2)
 
-	c.conn = &Connection{conn: conn, release: func() {}}
-	c.conn.remoteAddress = serverAddress
-	c.conn.init()
-	c.eventChan <- &Event{Type: EventConnected, Conn: c.conn}
+	c.conn = &Connection{conn: conn, eventChan: c.eventChan, release: func() {}}
+	c.conn.remoteAddress = conn.RemoteAddr().String()
+	c.conn.init(c.config)
 
-	c.conn.packetHandler = config.PacketHandlerFactory(c.conn.conn)
+	c.conn.setPacketHandler(c.config.newPacketHandler(c.conn.conn))
 
-	go c.conn.loop(c.eventChan)
+	go c.conn.loop()
 
 	return c.conn, c.eventChan, nil
 }
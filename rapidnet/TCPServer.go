@@ -1,18 +1,42 @@
 package rapidnet
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
+	"net/http"
+	"sync"
+	"time"
 )
 
 // TCPServer struct
 type TCPServer struct {
-	stopCmdChan  chan struct{}
-	exitLoopChan chan struct{}
+	config *Config // 为nil时使用全局配置
+
+	stopCmdChan  chan struct{} // 停止时关闭
+	exitLoopChan chan struct{} // accept循环退出时关闭
+
+	listener net.Listener
+	stopOnce sync.Once
 
 	maxClientsCount uint32
 	conns           connections
 
 	eventChan chan *Event
+	handler   Handler
+
+	tlsConfig *tls.Config // 不为nil时, 接受的连接需要先完成TLS握手
+
+	proxy *ProxyProtocol // 不为nil时, 接受的连接需要先读取PROXY头
+
+	rejectSem chan struct{} // 正在发送拒绝数据包的连接
+
+	limiter *acceptLimiter // 为nil时不限制
+	reactor *reactor       // EventLoops模式的事件循环, 为nil时使用goroutine模式
+
+	groups GroupManager
+
+	stats serverStats
 }
 
 // Start function
@@ -27,53 +51,354 @@ func (s *TCPServer) Start(address string, maxClientsAllowed uint32) (<-chan *Eve
 		return nil, err
 	}
 
-	s.stopCmdChan = make(chan struct{}, 1)
-	s.exitLoopChan = make(chan struct{}, 1)
+	return s.Serve(netListener, maxClientsAllowed)
+}
+
+// StartTLS 启动TLS服务器. 握手在连接的goroutine中进行, 超时时间由Config.HandshakeTimeout指定
+func (s *TCPServer) StartTLS(address string, maxClientsAllowed uint32, tlsConfig *tls.Config) (<-chan *Event, error) {
+	s.tlsConfig = tlsConfig
+	return s.Start(address, maxClientsAllowed)
+}
+
+// StartTLSWithHandler 启动TLS服务器, 连接事件及收到的数据通过handler回调通知
+func (s *TCPServer) StartTLSWithHandler(address string, maxClientsAllowed uint32, tlsConfig *tls.Config, handler Handler) error {
+	s.tlsConfig = tlsConfig
+	return s.StartWithHandler(address, maxClientsAllowed, handler)
+}
+
+// Serve 在已有的listener上接受连接, 可用于非TCP的传输层, 例如Unix socket(net.Listen("unix", path))、
+// websocket、PipeListener及已打开的文件描述符(net.FileListener).
+// AcceptLimits只对IP地址生效, EventLoops只用于TCP连接
+func (s *TCPServer) Serve(l net.Listener, maxClientsAllowed uint32) (<-chan *Event, error) {
+	s.stopCmdChan = make(chan struct{})
+	s.exitLoopChan = make(chan struct{})
 	s.eventChan = make(chan *Event, 1024)
+	s.listener = l
 
 	s.maxClientsCount = maxClientsAllowed
 	s.conns.init(maxClientsAllowed)
+	s.rejectSem = make(chan struct{}, maxConcurrentRejects)
+	s.limiter = newAcceptLimiter(s.config.acceptLimits())
+	s.proxy = s.config.proxyProtocol()
+	if n := s.config.eventLoops(); n > 0 {
+		interval, _ := s.config.heartbeat()
+		s.reactor = newReactor(n, interval)
+	}
 
-	go s.loop(netListener)
+	go s.loop(l)
 
 	return s.eventChan, nil
 }
 
-// Stop function
+// StartWithHandler 启动服务器, 连接事件及收到的数据通过handler回调通知
+func (s *TCPServer) StartWithHandler(address string, maxClientsAllowed uint32, handler Handler) error {
+	s.handler = handler
+	_, err := s.Start(address, maxClientsAllowed)
+	return err
+}
+
+// ServeWithHandler 在已有的listener上接受连接, 连接事件及收到的数据通过handler回调通知
+func (s *TCPServer) ServeWithHandler(l net.Listener, maxClientsAllowed uint32, handler Handler) error {
+	s.handler = handler
+	_, err := s.Serve(l, maxClientsAllowed)
+	return err
+}
+
+// Addr 返回监听的地址
+func (s *TCPServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stop 关闭监听, 不再接受新连接. 已建立的连接不受影响
 func (s *TCPServer) Stop() {
-	s.stopCmdChan <- struct{}{}
+	s.stopOnce.Do(func() {
+		close(s.stopCmdChan)
+		s.listener.Close()
+	})
 	<-s.exitLoopChan
+	if s.reactor != nil {
+		s.reactor.stop()
+	}
+}
+
+// Shutdown 优雅关闭服务器.
+// 立即关闭监听, 各连接发送完队列中的数据后断开并通知EventDisconnected,
+// 所有连接退出后返回nil. 若ctx先结束, 强制断开剩余连接并返回ctx.Err().
+// 调用方需要继续读取事件chan, 否则连接可能无法退出.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	s.Stop()
+
+	s.conns.close(func(conn *Connection) { conn.shutdown() })
+
+	select {
+	case <-s.conns.wait():
+		return nil
+	case <-ctx.Done():
+		s.conns.foreach(func(conn *Connection) bool {
+			conn.disconnect(ErrServerClosed)
+			return true
+		})
+		return ctx.Err()
+	}
+}
+
+// Groups 返回服务器的组管理器
+func (s *TCPServer) Groups() *GroupManager {
+	return &s.groups
+}
+
+// Stats 返回服务器的统计数据
+func (s *TCPServer) Stats() ServerStats {
+	return s.stats.snapshot()
+}
+
+// MetricsHandler 返回以Prometheus文本格式输出统计数据的http.Handler
+func (s *TCPServer) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.Stats().WritePrometheus(w)
+	})
+}
+
+// ForEach 对当前的每个连接调用f, f返回false时停止
+func (s *TCPServer) ForEach(f func(*Connection) bool) {
+	s.conns.foreach(f)
+}
+
+// Broadcast 向所有连接发送data, 不会阻塞.
+// 包处理器实现了FrameEncoder及FrameFormatter时, data对每种封包格式只编码一次, 编码后的帧由该格式的连接共享.
+// 返回因发送队列已满或连接已断开而丢弃的数量
+func (s *TCPServer) Broadcast(data []byte) int {
+	return s.BroadcastExcept(data, nil)
+}
+
+// BroadcastExcept 向except以外的所有连接发送data, 参见Broadcast
+func (s *TCPServer) BroadcastExcept(data []byte, except *Connection) int {
+	b := broadcast{data: data}
+	s.conns.foreach(func(conn *Connection) bool {
+		if conn != except {
+			b.send(conn)
+		}
+		return true
+	})
+	return b.dropped
 }
 
-func (s *TCPServer) loop(netListener *net.TCPListener) {
+func (s *TCPServer) loop(netListener net.Listener) {
+	defer close(s.exitLoopChan)
 	defer netListener.Close()
 
+	reject, _ := s.config.rejectWhenFull()
+
+	var tempDelay time.Duration // accept失败后的等待时间
 	for {
-		select {
-		case <-s.stopCmdChan:
-			s.exitLoopChan <- struct{}{}
+		if !reject && !s.conns.acquire(s.stopCmdChan) {
 			return
-		default:
-			//netListener.SetDeadline(time.Now().Add(time.Millisecond))
-			s.conns.acquire()
+		}
 
-			conn, err := netListener.AcceptTCP()
-			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-				s.conns.release()
-				continue
-			} else if err != nil {
+		conn, err := netListener.Accept()
+		if err != nil {
+			if !reject {
 				s.conns.release()
+			}
+
+			select {
+			case <-s.stopCmdChan:
 				return
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				time.Sleep(tempDelay)
+				continue
 			}
+			return
+		}
+		tempDelay = 0
+
+		if s.proxy != nil {
+			go s.readProxyHeader(conn, reject)
+			continue
+		}
+		s.accept(conn, reject)
+	}
+}
+
+// accept 检查限制后为conn建立连接, 需要TLS握手时在新的goroutine中进行.
+// reject为false时调用前已获取连接名额
+func (s *TCPServer) accept(conn net.Conn, reject bool) {
+	addr := conn.RemoteAddr()
+	if err := s.admit(addr); err != nil {
+		if !reject {
+			s.conns.release()
+		}
+		s.rejectConn(conn, err)
+		return
+	}
+	if reject && !s.conns.tryAcquire() {
+		s.limiter.done(addr)
+		s.rejectConn(conn, ErrServerFull)
+		return
+	}
+
+	if s.tlsConfig != nil {
+		go s.handshake(conn)
+		return
+	}
+	s.newConnection(conn, nil, nil)
+}
+
+// readProxyHeader 读取PROXY头后按客户端地址接受连接, 来源不可信、头格式错误或超时时拒绝连接
+func (s *TCPServer) readProxyHeader(conn net.Conn, reject bool) {
+	pc, err := s.proxy.Accept(conn)
+	if err != nil {
+		if !reject {
+			s.conns.release()
+		}
+		s.reject(conn, err, false)
+		return
+	}
+	s.accept(pc, reject)
+}
+
+// admit 检查是否接受来自addr的连接, 通过后计入每个IP的连接数
+func (s *TCPServer) admit(addr net.Addr) error {
+	if filter := s.config.acceptFilter(); filter != nil && !filter(addr) {
+		return ErrAcceptFiltered
+	}
+	return s.limiter.admit(addr)
+}
+
+// release 归还accept后未能建立Connection的连接占用的名额
+func (s *TCPServer) release(addr net.Addr) {
+	s.conns.release()
+	s.limiter.done(addr)
+}
+
+// 同时发送拒绝数据包的连接数上限, 超过时不发送直接关闭
+const maxConcurrentRejects = 64
+
+// rejectConn 拒绝conn. 需要发送拒绝数据包时在新的goroutine中发送,
+// 正在发送的数量达到maxConcurrentRejects时不发送直接关闭, 避免过载时goroutine无限增长
+func (s *TCPServer) rejectConn(conn net.Conn, err error) {
+	if _, serverFullPacket := s.config.rejectWhenFull(); err != ErrServerFull || serverFullPacket == nil {
+		s.reject(conn, err, false)
+		return
+	}
+
+	select {
+	case s.rejectSem <- struct{}{}:
+		go func() {
+			s.reject(conn, err, true)
+			<-s.rejectSem
+		}()
+	default:
+		s.reject(conn, err, false)
+	}
+}
 
-			newConn := &Connection{conn: conn, release: s.conns.release}
-			newConn.init()
+// AmplificationLimiter 可选接口, 由没有握手的数据报连接(例如udp.Conn)实现. 这类连接的远端地址可能是伪造的,
+// 发送拒绝数据包前调用LimitWrites, 之后写入的总字节数不能超过已收到的字节数, 超过时Write返回错误且不发送,
+// 避免服务器被用于反射放大攻击
+type AmplificationLimiter interface {
+	LimitWrites()
+}
 
-			s.conns.add(newConn)
-			newConn.packetHandler = config.PacketHandlerFactory(conn)
-			s.eventChan <- &Event{Type: EventConnected, Conn: newConn}
+// reject 关闭conn, 并通知EventRejected. 因ErrServerFull拒绝且sendPacket为true时先发送拒绝数据包,
+// 发送(包括TLS握手)的超时时间与握手超时时间相同. 事件chan已满时丢弃EventRejected
+func (s *TCPServer) reject(conn net.Conn, err error, sendPacket bool) {
+	addr := conn.RemoteAddr()
+	s.stats.rejected(rejectReason(err))
 
-			go newConn.loop(s.eventChan)
+	if _, serverFullPacket := s.config.rejectWhenFull(); sendPacket && err == ErrServerFull && serverFullPacket != nil {
+		if data := serverFullPacket(addr); data != nil {
+			if l, ok := conn.(AmplificationLimiter); ok {
+				l.LimitWrites()
+			}
+			if s.tlsConfig != nil {
+				conn = tls.Server(conn, s.tlsConfig)
+			}
+			conn.SetDeadline(time.Now().Add(s.config.handshakeTimeout()))
+			h := s.config.newPacketHandler(conn)
+			if h.Send(data) == nil {
+				h.Flush()
+			}
 		}
 	}
+	conn.Close()
+
+	e := &Event{Type: EventRejected, Err: err, Addr: addr}
+	if s.handler == nil {
+		select {
+		case s.eventChan <- e:
+		default:
+		}
+	} else if h, ok := s.handler.(RejectHandler); ok {
+		h.OnRejected(e.Addr, e.Err)
+	}
+}
+
+// handshake 完成TLS握手后建立连接, 握手失败或超时时关闭连接
+func (s *TCPServer) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, s.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(s.config.handshakeTimeout()))
+	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		s.release(conn.RemoteAddr())
+		s.stats.rejected("handshake")
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	s.newConnection(tlsConn, nil, nil)
+}
+
+// newConnection 为已获取名额的conn创建Connection, 服务器关闭后直接断开.
+// metadata及unread为旧进程交出连接时附带的数据及已读取但还没有处理的数据
+func (s *TCPServer) newConnection(conn net.Conn, metadata []byte, unread []byte) {
+	addr := conn.RemoteAddr()
+	newConn := &Connection{conn: conn, eventChan: s.eventChan, handler: s.handler}
+	newConn.release = func() {
+		s.conns.remove(newConn)
+		s.limiter.done(addr)
+	}
+	newConn.init(s.config)
+	newConn.stats.server = &s.stats
+	newConn.handoff.received = metadata
+	// 登记后可能被Broadcast等并发读取, 需要先设置
+	newConn.setPacketHandler(s.newPacketHandler(conn, unread))
+
+	if !s.conns.add(newConn) {
+		conn.Close()
+		s.release(addr)
+		s.stats.rejected("shutdown")
+		return
+	}
+
+	if s.reactor != nil && s.reactor.register(newConn, unread) {
+		return
+	}
+	go newConn.loop()
+}
+
+// newPacketHandler 创建conn的包处理器, 先接收unread中的数据.
+// 包处理器没有实现Unreader时, 使用先读取unread的包装连接重新创建
+func (s *TCPServer) newPacketHandler(conn net.Conn, unread []byte) PacketHandler {
+	h := s.config.newPacketHandler(conn)
+	if len(unread) == 0 {
+		return h
+	}
+	if u, ok := h.(Unreader); ok {
+		u.Restore(unread)
+		return h
+	}
+	return s.config.newPacketHandler(&unreadConn{Conn: conn, unread: unread})
 }
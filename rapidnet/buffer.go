@@ -0,0 +1,76 @@
+package rapidnet
+
+// 缓冲池的大小等级及每个等级最多缓存的数量, 超过最大等级的缓冲区不缓存
+var bufferClasses = []struct {
+	size  int
+	count int
+}{
+	{64, 4096},
+	{256, 2048},
+	{1024, 1024},
+	{4096, 512},
+	{16384, 128},
+	{65536, 32},
+}
+
+// bufferPool 每个大小等级的空闲缓冲区.
+// 使用chan而不是sync.Pool, 归还[]byte时不需要额外分配内存
+type bufferPool []chan []byte
+
+func newBufferPool() bufferPool {
+	pool := make(bufferPool, len(bufferClasses))
+	for i, class := range bufferClasses {
+		pool[i] = make(chan []byte, class.count)
+	}
+	return pool
+}
+
+// get 分配长度为n的缓冲区, 超过最大等级时直接分配
+func (pool bufferPool) get(n int) []byte {
+	for i, class := range bufferClasses {
+		if n > class.size {
+			continue
+		}
+		select {
+		case b := <-pool[i]:
+			return b[:n]
+		default:
+			return make([]byte, n, class.size)
+		}
+	}
+	return make([]byte, n)
+}
+
+// put 归还b, 容量与大小等级不同或该等级已满时忽略
+func (pool bufferPool) put(b []byte) {
+	c := cap(b)
+	for i, class := range bufferClasses {
+		if c != class.size {
+			continue
+		}
+		select {
+		case pool[i] <- b[:0]:
+		default:
+		}
+		return
+	}
+}
+
+// bufferPools NewPacket及Packet.Release使用的全局缓冲池
+var bufferPools = newBufferPool()
+
+// Packet 收到的数据包. 实现了PooledPacketHandler的包处理器(例如LengthFieldPacketHandler)从缓冲池中分配数据包,
+// 上层处理完(包括OnPacket返回后或从ReceiveDataChan读出并处理后)可以调用Release归还,
+// 不调用Release时由GC回收.
+type Packet []byte
+
+// NewPacket 从缓冲池中分配长度为n的数据包, 可用于实现PacketHandler
+func NewPacket(n int) Packet {
+	return bufferPools.get(n)
+}
+
+// Release 将数据包归还到缓冲池, 之后不能再使用p及其子切片.
+// 只有容量与某个大小等级相同的数据包会被缓存, 其它的忽略
+func (p Packet) Release() {
+	bufferPools.put(p)
+}
@@ -0,0 +1,59 @@
+package rapidnet
+
+import "testing"
+
+func TestPacket_Release(t *testing.T) {
+	// 使用单独的缓冲池, 不受其它测试归还的缓冲区影响
+	pool := newBufferPool()
+
+	p := pool.get(100)
+	if len(p) != 100 || cap(p) != 256 {
+		t.Fatal("unexpected packet:", len(p), cap(p))
+	}
+	p[0] = 1
+	pool.put(p)
+
+	// 从缓冲池中取回同一个缓冲区
+	if q := pool.get(200); &q[:1][0] != &p[:1][0] {
+		t.Fatal("expect pooled buffer")
+	}
+
+	if p := pool.get(1 << 20); len(p) != 1<<20 {
+		t.Fatal("unexpected packet:", len(p))
+	}
+	// 不是从缓冲池分配的数据包归还时被忽略
+	pool.put(make([]byte, 10))
+	for i := range pool {
+		if len(pool[i]) != 0 {
+			t.Fatal("unexpected pooled buffer in class", i)
+		}
+	}
+
+	// NewPacket及Release使用全局缓冲池
+	if p := NewPacket(100); len(p) != 100 || cap(p) != 256 {
+		t.Fatal("unexpected packet:", len(p), cap(p))
+	}
+}
+
+type reusingHandler struct{ PacketHandler }
+
+func TestConnection_ReleasePacket(t *testing.T) {
+	for len(bufferPools[1]) > 0 {
+		<-bufferPools[1]
+	}
+	buf := make([]byte, 100, 256)
+
+	// 包处理器自己的缓冲区不能归还到缓冲池
+	c := &Connection{}
+	c.setPacketHandler(reusingHandler{})
+	c.releasePacket(buf)
+	if q := NewPacket(200); &q[:1][0] == &buf[:1][0] {
+		t.Fatal("unexpected pooled buffer")
+	}
+
+	c.setPacketHandler(&LengthFieldPacketHandler{})
+	c.releasePacket(buf)
+	if q := NewPacket(200); &q[:1][0] != &buf[:1][0] {
+		t.Fatal("expect pooled buffer")
+	}
+}
@@ -1,11 +1,11 @@
 package rapidnet
 
 import (
-	"errors"
+	"context"
 	"net"
 	"sync"
-
-	"github.com/lzhig/rapidgo/base"
+	"sync/atomic"
+	"time"
 )
 
 // 用于向上层传递收到的数据包
@@ -14,29 +14,100 @@ type dataChan struct {
 	conn *Connection
 }
 
+// 发送队列中的数据
+type outgoing struct {
+	data  []byte
+	frame bool // data是FrameEncoder编码好的帧
+	size  int  // frame为true时, 编码前数据的长度
+}
+
+// len 返回数据包的长度, 不包括帧的包头
+func (p outgoing) len() int {
+	if p.frame {
+		return p.size
+	}
+	return len(p.data)
+}
+
+// 用于分配连接ID
+var lastConnectionID uint64
+
 // Connection object
 type Connection struct {
+	id            uint64   // 连接ID, 进程内唯一且递增
 	remoteAddress string   // 远端地址
 	conn          net.Conn // 底层连接
 
 	packetHandler PacketHandler // 包处理器
 
+	eventChan chan *Event // 未设置handler时, 事件发送到此chan
+	handler   Handler     // 事件回调
+
 	receiveDataChan chan []byte
-	sendDataChan    chan []byte
+	sendDataChan    chan outgoing
 
 	stopCmdChan      chan struct{} // 断开时发送此命令
 	stopSendLoopChan chan struct{}
+	drainCmdChan     chan struct{} // 发送完队列中的数据后断开
+	detachCmdChan    chan struct{} // 发送完队列中的数据后停止收发, 不关闭连接
+	sendExitChan     chan struct{} // sendLoop退出时关闭
+	exitChan         chan struct{} // loop退出时关闭
 
 	release func()
 
 	releaseOnce sync.Once
+	drainOnce   sync.Once
+	detachOnce  sync.Once
+	stopErr     error // 主动断开的原因
+
+	heartbeatInterval  time.Duration // 为0时不启用心跳
+	heartbeatMaxMissed int32
+	heartbeatMissed    int32         // 已发送但还没有收到数据的心跳次数
+	lastReceiveTime    int64         // 最后收到数据的时间(UnixNano)
+	pongChan           chan struct{} // 需要回复心跳
+
+	sendPolicy SendPolicy    // 发送队列已满时的处理方式
+	flushDelay time.Duration // 合并写入的最大延迟
+
+	receiveLimiter *rateLimiter // 收到数据的速率限制, 为nil时不限制
+	maxPacketSize  int          // 收到的数据包的最大长度, 为0时不限制
+	pooled         bool         // 包处理器返回的数据包由缓冲池分配
+
+	groupsMutex  sync.Mutex
+	groups       map[*Group]struct{} // 加入的组
+	groupsClosed bool                // 已断开, 不能再加入组
+
+	valuesMutex sync.RWMutex
+	values      map[interface{}]interface{} // 上层保存的数据
+
+	stats connStats
+
+	poll *pollState // EventLoops模式下的状态, 为nil时使用每个连接两个goroutine的模式
+
+	handoff handoffState
 }
 
-func (c *Connection) init() {
+func (c *Connection) init(cfg *Config) {
+	c.id = atomic.AddUint64(&lastConnectionID, 1)
+	c.stats.connectedAt = time.Now()
 	c.receiveDataChan = make(chan []byte, 16)
-	c.sendDataChan = make(chan []byte, 16)
+	c.sendDataChan = make(chan outgoing, cfg.sendQueueSize())
+	c.sendPolicy = cfg.sendPolicy()
+	c.flushDelay = cfg.flushDelay()
+	c.receiveLimiter = newRateLimiter(cfg.receiveRate())
+	c.maxPacketSize = cfg.maxPacketSize()
 	c.stopCmdChan = make(chan struct{})
 	c.stopSendLoopChan = make(chan struct{})
+	c.drainCmdChan = make(chan struct{})
+	c.detachCmdChan = make(chan struct{})
+	c.sendExitChan = make(chan struct{})
+	c.exitChan = make(chan struct{})
+
+	interval, maxMissed := cfg.heartbeat()
+	c.heartbeatInterval = interval
+	c.heartbeatMaxMissed = int32(maxMissed)
+	c.lastReceiveTime = time.Now().UnixNano()
+	c.pongChan = make(chan struct{}, 1)
 }
 
 // ReceiveDataChan 返回连接接收到的数据chan
@@ -44,71 +115,500 @@ func (c *Connection) ReceiveDataChan() <-chan []byte {
 	return c.receiveDataChan
 }
 
+// ID 返回连接ID, 进程内唯一且单调递增
+func (c *Connection) ID() uint64 {
+	return c.id
+}
+
+// SetValue 在连接上保存与key关联的数据, 例如用户ID、认证状态等.
+// 与context.WithValue类似, key应使用自定义的类型以避免冲突. 连接断开后数据仍然可以读取
+func (c *Connection) SetValue(key, value interface{}) {
+	c.valuesMutex.Lock()
+	defer c.valuesMutex.Unlock()
+
+	if c.values == nil {
+		c.values = make(map[interface{}]interface{})
+	}
+	c.values[key] = value
+}
+
+// Value 返回与key关联的数据, 不存在时返回nil
+func (c *Connection) Value(key interface{}) interface{} {
+	c.valuesMutex.RLock()
+	defer c.valuesMutex.RUnlock()
+
+	return c.values[key]
+}
+
+// DeleteValue 删除与key关联的数据
+func (c *Connection) DeleteValue(key interface{}) {
+	c.valuesMutex.Lock()
+	defer c.valuesMutex.Unlock()
+
+	delete(c.values, key)
+}
+
+// Stats 返回连接的统计数据
+func (c *Connection) Stats() ConnectionStats {
+	return c.stats.snapshot()
+}
+
 // RemoteAddr function
 func (c *Connection) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+// Disconnect 立即断开连接
 func (c *Connection) Disconnect() {
-	c.releaseOnce.Do(c._disconnect)
+	c.disconnect(errStopped)
+}
+
+func (c *Connection) disconnect(err error) {
+	c.releaseOnce.Do(func() {
+		c.stopErr = err
+		close(c.stopCmdChan)
+		c.conn.Close()
+		if c.poll != nil {
+			c.poll.loop.closed(c)
+		}
+	})
 }
 
-func (c *Connection) _disconnect() {
-	c.conn.Close()
-	close(c.stopCmdChan)
+// shutdown 不再发送新数据, 发送完队列中已有的数据后断开连接
+func (c *Connection) shutdown() {
+	c.drainOnce.Do(func() {
+		close(c.drainCmdChan)
+		if c.poll != nil {
+			go c.drain()
+		}
+	})
 }
 
-func (c *Connection) loop(eventChan chan *Event) {
+func (c *Connection) loop() {
+	defer close(c.exitChan)
+	defer c.release()
 	defer c.conn.Close()
 
-	go c.sendLoop(eventChan)
+	go c.sendLoop()
 	defer close(c.receiveDataChan)
 	defer close(c.stopSendLoopChan)
-	defer c.release()
+
+	c.notify(&Event{Type: EventConnected, Conn: c})
 
 	for {
 		select {
 		case <-c.stopCmdChan:
-			eventChan <- &Event{Type: EventDisconnected, Err: errors.New("stopped"), Conn: c}
+			c.onDisconnected(c.stopErr)
+			return
+
+		case <-c.detachCmdChan:
+			c.onDetached()
 			return
 
 		default:
 			data, err := c.packetHandler.Receive()
 			if err != nil {
 				//base.LogError("Receive() return error:", err)
-				eventChan <- &Event{Type: EventDisconnected, Err: err, Conn: c}
+				select {
+				case <-c.stopCmdChan:
+					// 主动断开导致的错误, 使用断开的原因
+					err = c.stopErr
+				default:
+				}
+				c.onDisconnected(err)
 				return
 			}
 
-			if data != nil {
-				c.receiveDataChan <- data
+			if data == nil {
+				continue
+			}
+			if c.onReceive(data) {
+				c.releasePacket(data)
+				continue
+			}
+			c.stats.packetIn(len(data))
+			if c.limit(data) {
+				c.deliver(data)
+			} else {
+				c.releasePacket(data)
 			}
 		}
 	}
 }
 
-func (c *Connection) sendLoop(eventChan chan *Event) {
+// limit 检查收到的数据包的长度及速率, 需要延迟时等待, 返回false时丢弃
+func (c *Connection) limit(data []byte) bool {
+	ok, d := c.checkLimit(data)
+	if ok && d > 0 {
+		return c.sleep(d)
+	}
+	return ok
+}
+
+// setPacketHandler 设置包处理器, 包处理器实现了PacketSizeLimiter时由包处理器检查MaxPacketSize
+func (c *Connection) setPacketHandler(h PacketHandler) {
+	if l, ok := h.(PacketSizeLimiter); ok && c.maxPacketSize > 0 {
+		l.SetMaxPacketSize(c.maxPacketSize)
+	}
+	if p, ok := h.(PooledPacketHandler); ok {
+		c.pooled = p.PooledPackets()
+	}
+	c.packetHandler = h
+}
+
+// releasePacket 丢弃包处理器返回的数据包, 数据包由缓冲池分配时归还
+func (c *Connection) releasePacket(data []byte) {
+	if c.pooled {
+		Packet(data).Release()
+	}
+}
+
+// checkLimit 检查收到的数据包的长度及速率, 返回false时丢弃. 使用RateLimitDelay时返回需要延迟的时间
+func (c *Connection) checkLimit(data []byte) (bool, time.Duration) {
+	if c.maxPacketSize > 0 && len(data) > c.maxPacketSize {
+		c.disconnect(ErrPacketTooLarge)
+		return false, 0
+	}
+	if c.receiveLimiter == nil {
+		return true, 0
+	}
+
+	action := c.receiveLimiter.limit.Action
+	d := c.receiveLimiter.take(len(data), time.Now(), action == RateLimitDelay)
+	if d == 0 {
+		return true, 0
+	}
+
+	switch action {
+	case RateLimitDelay:
+		return true, d
+	case RateLimitDisconnect:
+		c.disconnect(ErrRateLimited)
+	default:
+		c.stats.receiveDropped()
+	}
+	return false, 0
+}
+
+// sleep 等待d, 连接断开时返回false
+func (c *Connection) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.detachCmdChan:
+		// 连接将交给其它进程, 不再等待
+		return true
+	case <-c.stopCmdChan:
+		return false
+	}
+}
+
+// onDisconnected 离开所有的组后通知上层连接已断开
+func (c *Connection) onDisconnected(err error) {
+	c.leaveGroups()
+	c.stats.disconnected(err)
+	c.notify(&Event{Type: EventDisconnected, Err: err, Conn: c})
+}
+
+// onReceive 记录收到数据的时间, 如果data是心跳包返回true
+func (c *Connection) onReceive(data []byte) bool {
+	if c.heartbeatInterval == 0 {
+		return false
+	}
+
+	atomic.StoreInt64(&c.lastReceiveTime, time.Now().UnixNano())
+	missed := atomic.SwapInt32(&c.heartbeatMissed, 0)
+	if len(data) != 0 {
+		return false
+	}
+
+	// 自己发送的心跳还没有收到回复时, 对端的心跳包即视为回复, 否则需要回复心跳
+	if missed == 0 {
+		if c.poll != nil {
+			c.sendHeartbeatAsync()
+		} else {
+			select {
+			case c.pongChan <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return true
+}
+
+func (c *Connection) sendLoop() {
+	defer close(c.sendExitChan)
+
+	var heartbeatChan <-chan time.Time
+	if c.heartbeatInterval > 0 {
+		ticker := time.NewTicker(c.heartbeatInterval)
+		defer ticker.Stop()
+		heartbeatChan = ticker.C
+	}
+
+	// 设置了flushDelay时, 第一批数据写入后启动flushTimer, 超时后flush
+	var flushTimer *time.Timer
+	var flushChan <-chan time.Time
+	if c.flushDelay > 0 {
+		flushTimer = time.NewTimer(c.flushDelay)
+		flushTimer.Stop()
+		defer flushTimer.Stop()
+	}
+
 	for {
+		var err error
 		select {
 		case <-c.stopSendLoopChan:
 			return
 
-		case data := <-c.sendDataChan:
-			if err := c.packetHandler.Send(data); err != nil {
-				eventChan <- &Event{Type: EventSendFailed, Err: err, Conn: c}
+		case <-heartbeatChan:
+			if !c.checkHeartbeat() {
 				return
 			}
+
+		case <-c.pongChan:
+			err = c.sendHeartbeat()
+
+		case <-c.drainCmdChan:
+			c.flushSendQueue()
+			c.disconnect(ErrServerClosed)
+			return
+
+		case <-c.detachCmdChan:
+			c.flushSendQueue()
+			return
+
+		case <-flushChan:
+			flushChan = nil
+			err = c.packetHandler.Flush()
+
+		case p := <-c.sendDataChan:
+			err = c.writeBatch(p)
+			switch {
+			case err != nil:
+			case flushTimer == nil:
+				err = c.packetHandler.Flush()
+			case flushChan == nil:
+				flushTimer.Reset(c.flushDelay)
+				flushChan = flushTimer.C
+			}
+		}
+
+		if err != nil {
+			c.sendFailed(err)
+			return
 		}
 	}
 }
 
-// Send send data
-func (c *Connection) Send(data []byte) {
+// writeBatch 写入p及发送队列中已有的数据, 不flush
+func (c *Connection) writeBatch(p outgoing) error {
+	if err := c.write(p); err != nil {
+		return err
+	}
+	for i := cap(c.sendDataChan); i > 0; i-- {
+		select {
+		case p := <-c.sendDataChan:
+			if err := c.write(p); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// sendHeartbeat 发送心跳包, 同时flush之前缓存的数据
+func (c *Connection) sendHeartbeat() error {
+	if err := c.packetHandler.Send(nil); err != nil {
+		return err
+	}
+	return c.packetHandler.Flush()
+}
+
+// write 通过包处理器发送队列中的数据, 数据可能缓存在包处理器中直到Flush
+func (c *Connection) write(p outgoing) error {
+	var err error
+	if p.frame {
+		err = c.packetHandler.(FrameEncoder).SendFrame(p.data)
+	} else {
+		err = c.packetHandler.Send(p.data)
+	}
+	if err == nil {
+		c.stats.packetOut(p.len())
+	}
+	return err
+}
+
+// checkHeartbeat 空闲超过心跳间隔时发送心跳包, 丢失次数过多时断开连接. 需要退出sendLoop时返回false
+func (c *Connection) checkHeartbeat() bool {
+	due, ok := c.heartbeatDue()
+	if !due {
+		return ok
+	}
+
+	if err := c.sendHeartbeat(); err != nil {
+		c.sendFailed(err)
+		return false
+	}
+	return true
+}
+
+// heartbeatDue 空闲超过心跳间隔时返回due为true, 需要发送心跳包.
+// 连续丢失的次数过多时以ErrIdleTimeout断开连接, ok为false
+func (c *Connection) heartbeatDue() (due bool, ok bool) {
+	idle := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&c.lastReceiveTime))
+	if idle < c.heartbeatInterval {
+		return false, true
+	}
+
+	if atomic.AddInt32(&c.heartbeatMissed, 1) > c.heartbeatMaxMissed {
+		c.disconnect(ErrIdleTimeout)
+		return false, false
+	}
+	return true, true
+}
+
+// flushSendQueue 发送队列中剩余的数据
+func (c *Connection) flushSendQueue() {
+	for {
+		select {
+		case p := <-c.sendDataChan:
+			if err := c.write(p); err != nil {
+				c.sendFailed(err)
+				return
+			}
+		default:
+			if err := c.packetHandler.Flush(); err != nil {
+				c.sendFailed(err)
+			}
+			return
+		}
+	}
+}
+
+// sendFailed 通知EventSendFailed. 连接已断开时写入失败是关闭连接导致的, 不再通知
+func (c *Connection) sendFailed(err error) {
+	select {
+	case <-c.stopCmdChan:
+		return
+	case <-c.stopSendLoopChan:
+		return
+	default:
+	}
+	c.notify(&Event{Type: EventSendFailed, Err: err, Conn: c})
+}
+
+// notify 通知上层事件. 设置了handler时直接回调, 否则发送到事件chan
+func (c *Connection) notify(e *Event) {
+	if c.handler == nil {
+		c.eventChan <- e
+		return
+	}
+
+	switch e.Type {
+	case EventConnected:
+		c.handler.OnConnected(c)
+	case EventDisconnected:
+		c.handler.OnDisconnected(c, e.Err)
+	case EventSendFailed:
+		c.handler.OnSendFailed(c, e.Err)
+	}
+}
+
+// deliver 向上层传递收到的数据
+func (c *Connection) deliver(data []byte) {
+	if c.handler != nil {
+		c.handler.OnPacket(c, data)
+		return
+	}
+
+	select {
+	case c.receiveDataChan <- data:
+	case <-c.detachCmdChan:
+		// 交给新进程处理
+		c.handoff.pending = data
+	case <-c.stopCmdChan:
+		c.releasePacket(data)
+	}
+}
+
+// Send 将数据放入发送队列. 队列已满时的处理方式由Config.SendPolicy决定
+func (c *Connection) Send(data []byte) error {
+	if c.sendPolicy == SendPolicyBlock {
+		return c.SendContext(context.Background(), data)
+	}
+	return c.offer(outgoing{data: data})
+}
+
+// TrySend 将数据放入发送队列, 队列已满时返回ErrSendQueueFull, 连接已断开时返回ErrConnClosed
+func (c *Connection) TrySend(data []byte) error {
+	return c.trySend(outgoing{data: data})
+}
+
+// SendContext 将数据放入发送队列, 队列已满时等待, 直到放入队列、ctx结束或连接断开
+func (c *Connection) SendContext(ctx context.Context, data []byte) error {
+	if c.isClosed() {
+		return ErrConnClosed
+	}
+
+	select {
+	case c.sendDataChan <- outgoing{data: data}:
+		c.kick()
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.stopCmdChan:
+		return ErrConnClosed
+	case <-c.stopSendLoopChan:
+		return ErrConnClosed
+	case <-c.drainCmdChan:
+		return ErrConnClosed
+	case <-c.detachCmdChan:
+		return ErrConnClosed
+	}
+}
+
+func (c *Connection) trySend(p outgoing) error {
+	if c.isClosed() {
+		return ErrConnClosed
+	}
+
+	select {
+	case c.sendDataChan <- p:
+		c.kick()
+		return nil
+	default:
+		c.stats.sendDropped()
+		return ErrSendQueueFull
+	}
+}
+
+// offer 不阻塞地放入发送队列, 队列已满且使用SendPolicyDisconnect时断开连接
+func (c *Connection) offer(p outgoing) error {
+	err := c.trySend(p)
+	if err == ErrSendQueueFull && c.sendPolicy == SendPolicyDisconnect {
+		c.disconnect(ErrSlowConsumer)
+	}
+	return err
+}
+
+// isClosed 连接是否已断开或正在关闭, 此时放入发送队列的数据不会被发送
+func (c *Connection) isClosed() bool {
 	select {
-	case c.sendDataChan <- data:
+	case <-c.stopCmdChan:
+		return true
+	case <-c.stopSendLoopChan:
+		return true
+	case <-c.drainCmdChan:
+		return true
+	case <-c.detachCmdChan:
+		return true
 	default:
-		//panic(errors.New("[rapidnet] connection Send: sendDataChan is full"))
-		base.LogError("connection Send: sendDataChan is full")
+		return false
 	}
 }
 
@@ -117,6 +617,8 @@ type connections struct {
 	connections map[*Connection]*Connection
 	mutex       sync.Mutex
 	sem         chan struct{}
+	wg          sync.WaitGroup // 等待所有连接退出
+	closed      bool           // 服务器关闭后不再添加连接
 }
 
 func (conns *connections) init(n uint32) {
@@ -128,11 +630,21 @@ func (conns *connections) size() uint32 {
 	return uint32(len(conns.connections))
 }
 
-func (conns *connections) add(conn *Connection) {
+// add 添加连接, 服务器关闭后返回false
+func (conns *connections) add(conn *Connection) bool {
 	conns.mutex.Lock()
 	defer conns.mutex.Unlock()
 
+	if conns.closed {
+		return false
+	}
 	conns.connections[conn] = conn
+	conns.wg.Add(1)
+	if conn.stats.server != nil {
+		atomic.AddInt64(&conn.stats.server.active, 1)
+		atomic.AddUint64(&conn.stats.server.accepted, 1)
+	}
+	return true
 }
 
 func (conns *connections) remove(conn *Connection) {
@@ -140,10 +652,71 @@ func (conns *connections) remove(conn *Connection) {
 	defer conns.mutex.Unlock()
 
 	delete(conns.connections, conn)
+	if conn.stats.server != nil {
+		atomic.AddInt64(&conn.stats.server.active, -1)
+	}
 	conns.release()
+	conns.wg.Done()
+}
+
+// close 不再添加连接, 并对当前所有连接调用f
+func (conns *connections) close(f func(*Connection)) {
+	conns.mutex.Lock()
+	conns.closed = true
+	conns.mutex.Unlock()
+
+	conns.foreach(func(conn *Connection) bool {
+		f(conn)
+		return true
+	})
+}
+
+// foreach 对当前所有连接调用f, f返回false时停止
+func (conns *connections) foreach(f func(*Connection) bool) {
+	conns.mutex.Lock()
+	list := make([]*Connection, 0, len(conns.connections))
+	for conn := range conns.connections {
+		list = append(list, conn)
+	}
+	conns.mutex.Unlock()
+
+	for _, conn := range list {
+		if !f(conn) {
+			return
+		}
+	}
+}
+
+// wait 返回一个chan, 所有连接退出后关闭
+func (conns *connections) wait() <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		conns.wg.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+// acquire 获取一个连接名额, cancel关闭时返回false
+func (conns *connections) acquire(cancel <-chan struct{}) bool {
+	select {
+	case conns.sem <- struct{}{}:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// tryAcquire 不等待地获取一个连接名额
+func (conns *connections) tryAcquire() bool {
+	select {
+	case conns.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
 }
 
-func (conns *connections) acquire() { conns.sem <- struct{}{} }
 func (conns *connections) release() { <-conns.sem }
 
 // CreateTCPClient creates a client object for tcp
@@ -151,7 +724,17 @@ func CreateTCPClient() *TCPClient {
 	return &TCPClient{}
 }
 
+// CreateTCPClientWithConfig creates a client object for tcp with its own config
+func CreateTCPClientWithConfig(cfg *Config) *TCPClient {
+	return &TCPClient{config: cfg}
+}
+
 // CreateTCPServer function a server object for tcp
 func CreateTCPServer() *TCPServer {
 	return &TCPServer{}
 }
+
+// CreateTCPServerWithConfig creates a server object for tcp with its own config
+func CreateTCPServerWithConfig(cfg *Config) *TCPServer {
+	return &TCPServer{config: cfg}
+}
@@ -0,0 +1,194 @@
+package rapidnet
+
+import (
+	"sync"
+)
+
+// Group 一组连接, 例如游戏中的房间. 可以并发使用.
+// 连接断开时, 在通知EventDisconnected之前自动离开所有的组
+type Group struct {
+	name string
+
+	mutex   sync.RWMutex
+	members map[*Connection]struct{}
+}
+
+// NewGroup 创建组
+func NewGroup(name string) *Group {
+	return &Group{name: name, members: make(map[*Connection]struct{})}
+}
+
+// Name 返回组名
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Join 将连接加入组, 连接已断开时返回false
+func (g *Group) Join(conn *Connection) bool {
+	conn.groupsMutex.Lock()
+	defer conn.groupsMutex.Unlock()
+
+	if conn.groupsClosed {
+		return false
+	}
+	if conn.groups == nil {
+		conn.groups = make(map[*Group]struct{})
+	}
+	conn.groups[g] = struct{}{}
+
+	g.mutex.Lock()
+	g.members[conn] = struct{}{}
+	g.mutex.Unlock()
+	return true
+}
+
+// Leave 将连接移出组
+func (g *Group) Leave(conn *Connection) {
+	conn.groupsMutex.Lock()
+	defer conn.groupsMutex.Unlock()
+
+	delete(conn.groups, g)
+	g.remove(conn)
+}
+
+// Contains 连接是否在组中
+func (g *Group) Contains(conn *Connection) bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	_, ok := g.members[conn]
+	return ok
+}
+
+// Len 返回组中连接的数量
+func (g *Group) Len() int {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	return len(g.members)
+}
+
+// Members 返回组中的所有连接
+func (g *Group) Members() []*Connection {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	list := make([]*Connection, 0, len(g.members))
+	for conn := range g.members {
+		list = append(list, conn)
+	}
+	return list
+}
+
+// ForEach 对组中的每个连接调用f, f返回false时停止
+func (g *Group) ForEach(f func(*Connection) bool) {
+	for _, conn := range g.Members() {
+		if !f(conn) {
+			return
+		}
+	}
+}
+
+// Broadcast 向组中的所有连接发送data, 参见TCPServer.Broadcast
+func (g *Group) Broadcast(data []byte) int {
+	return g.BroadcastExcept(data, nil)
+}
+
+// BroadcastExcept 向组中except以外的所有连接发送data, 参见TCPServer.Broadcast
+func (g *Group) BroadcastExcept(data []byte, except *Connection) int {
+	b := broadcast{data: data}
+	g.ForEach(func(conn *Connection) bool {
+		if conn != except {
+			b.send(conn)
+		}
+		return true
+	})
+	return b.dropped
+}
+
+// clear 移出所有连接
+func (g *Group) clear() {
+	for _, conn := range g.Members() {
+		g.Leave(conn)
+	}
+}
+
+func (g *Group) remove(conn *Connection) {
+	g.mutex.Lock()
+	delete(g.members, conn)
+	g.mutex.Unlock()
+}
+
+// leaveGroups 连接断开时离开所有的组, 之后不能再加入组
+func (c *Connection) leaveGroups() {
+	c.groupsMutex.Lock()
+	defer c.groupsMutex.Unlock()
+
+	c.groupsClosed = true
+	for g := range c.groups {
+		g.remove(c)
+	}
+	c.groups = nil
+}
+
+// GroupManager 按名字管理组. 零值可以直接使用, 可以并发使用
+type GroupManager struct {
+	mutex  sync.Mutex
+	groups map[string]*Group
+}
+
+// Group 返回名为name的组, 不存在时创建
+func (m *GroupManager) Group(name string) *Group {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.groups == nil {
+		m.groups = make(map[string]*Group)
+	}
+	g, ok := m.groups[name]
+	if !ok {
+		g = NewGroup(name)
+		m.groups[name] = g
+	}
+	return g
+}
+
+// Find 返回名为name的组, 不存在时返回nil
+func (m *GroupManager) Find(name string) *Group {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.groups[name]
+}
+
+// Remove 删除名为name的组, 组中的连接全部离开
+func (m *GroupManager) Remove(name string) {
+	m.mutex.Lock()
+	g, ok := m.groups[name]
+	delete(m.groups, name)
+	m.mutex.Unlock()
+
+	if ok {
+		g.clear()
+	}
+}
+
+// Join 将连接加入名为name的组, 组不存在时创建. 连接已断开时返回false
+func (m *GroupManager) Join(name string, conn *Connection) bool {
+	return m.Group(name).Join(conn)
+}
+
+// Leave 将连接移出名为name的组
+func (m *GroupManager) Leave(name string, conn *Connection) {
+	if g := m.Find(name); g != nil {
+		g.Leave(conn)
+	}
+}
+
+// Broadcast 向名为name的组中的所有连接发送data, 返回丢弃的数量. 组不存在时返回0
+func (m *GroupManager) Broadcast(name string, data []byte) int {
+	if g := m.Find(name); g != nil {
+		return g.Broadcast(data)
+	}
+	return 0
+}
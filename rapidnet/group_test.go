@@ -0,0 +1,106 @@
+package rapidnet
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"time"
+)
+
+func TestGroup(t *testing.T) {
+	server := CreateTCPServer()
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	var clients, conns []*Connection
+	for i := 0; i < 2; i++ {
+		client, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Disconnect()
+		clients = append(clients, client)
+
+		conn := waitEvent(t, serverEvents, EventConnected).Conn
+		if !server.Groups().Join("room", conn) {
+			t.Fatal("failed to join")
+		}
+		conns = append(conns, conn)
+	}
+
+	room := server.Groups().Find("room")
+	if room == nil || room.Len() != 2 {
+		t.Fatal("expect 2 members")
+	}
+
+	if dropped := server.Groups().Broadcast("room", []byte("hi")); dropped != 0 {
+		t.Fatal("unexpected dropped:", dropped)
+	}
+	for _, client := range clients {
+		if data := <-client.ReceiveDataChan(); string(data) != "hi" {
+			t.Fatal("unexpected data:", data)
+		}
+	}
+
+	// 断开的连接自动离开组, 且不能再加入
+	conns[0].Disconnect()
+	waitEvent(t, serverEvents, EventDisconnected)
+	if room.Contains(conns[0]) || room.Len() != 1 {
+		t.Fatal("disconnected connection should leave the group")
+	}
+	if room.Join(conns[0]) {
+		t.Fatal("disconnected connection should not join")
+	}
+
+	server.Groups().Remove("room")
+	if room.Len() != 0 || server.Groups().Find("room") != nil {
+		t.Fatal("group should be removed")
+	}
+}
+
+func TestGroup_BroadcastMixedSpecs(t *testing.T) {
+	specs := []LengthFieldSpec{
+		DefaultLengthFieldSpec,
+		{Tag: []byte{0xAB}, LengthSize: 4, ByteOrder: binary.BigEndian, Checksum: crc32.ChecksumIEEE},
+	}
+
+	// 组中的连接来自封包格式不同的两个服务器
+	group := NewGroup("mixed")
+	var clients []*Connection
+	for _, spec := range specs {
+		cfg := &Config{PacketHandlerFactory: NewLengthFieldPacketHandlerFactory(spec)}
+		server := CreateTCPServerWithConfig(cfg)
+		serverEvents, err := server.Start("127.0.0.1:0", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Stop()
+
+		for i := 0; i < 2; i++ {
+			client, _, err := CreateTCPClientWithConfig(cfg).Connect(server.Addr().String(), 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Disconnect()
+			clients = append(clients, client)
+			group.Join(waitEvent(t, serverEvents, EventConnected).Conn)
+		}
+	}
+
+	if dropped := group.Broadcast([]byte("hi")); dropped != 0 {
+		t.Fatal("unexpected dropped:", dropped)
+	}
+	for _, client := range clients {
+		select {
+		case data := <-client.ReceiveDataChan():
+			if string(data) != "hi" {
+				t.Fatal("unexpected data:", data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for broadcast")
+		}
+	}
+}
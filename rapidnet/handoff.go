@@ -0,0 +1,437 @@
+package rapidnet
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// handoffEnv 新进程中与旧进程通信的Unix socket的文件描述符
+const handoffEnv = "RAPIDNET_HANDOFF_FD"
+
+const defaultHandoffTimeout = time.Second * 30
+
+// maxConcurrentDetaches 交出连接时同时停止收发的连接数
+const maxConcurrentDetaches = 64
+
+var (
+	// ErrHandedOff 连接已交给新进程, 连接断开事件携带此错误
+	ErrHandedOff = errors.New("rapidnet: connection handed off")
+
+	// ErrHandoffNotSupported 当前平台、listener或连接不支持交给其它进程
+	ErrHandoffNotSupported = errors.New("rapidnet: handoff not supported")
+
+	// ErrHandoffTimeout 在HandoffOptions.Timeout内没有完成交接.
+	// 已停止收发但没有交出的连接以此错误断开
+	ErrHandoffTimeout = errors.New("rapidnet: handoff timeout")
+)
+
+// HandoffOptions TCPServer.Handoff的参数
+type HandoffOptions struct {
+	// Command 启动的新进程, 为nil时使用当前的可执行文件及命令行参数.
+	// 不能设置ExtraFiles, 新进程通过环境变量找到与旧进程通信的socket
+	Command *exec.Cmd
+
+	// Conns 为true时同时交出已建立的连接, 交出的连接在Handoff结束后以ErrHandedOff通知断开.
+	// 只能交出包处理器实现了Unreader的TCP或Unix socket连接(不包括TLS及EventLoops模式),
+	// 其它连接仍由旧进程处理. 已放入ReceiveDataChan的数据包仍由旧进程处理,
+	// 因ReceiveDataChan已满而等待的数据包在包处理器实现了FrameEncoder时交给新进程, 否则丢弃
+	Conns bool
+
+	// Metadata 在连接的接收goroutine停止后调用, 返回的数据交给新进程, 通过Connection.HandoffMetadata读取.
+	// 多个连接同时停止收发, 不同连接的调用会并发执行
+	Metadata func(conn *Connection) []byte
+
+	// Timeout 等待连接停止收发及新进程接收listener及连接的总时间, 为0时使用30秒
+	Timeout time.Duration
+}
+
+func (opts *HandoffOptions) timeout() time.Duration {
+	if opts.Timeout > 0 {
+		return opts.Timeout
+	}
+	return defaultHandoffTimeout
+}
+
+// command 返回启动新进程的命令
+func (opts *HandoffOptions) command() (*exec.Cmd, error) {
+	if opts.Command != nil {
+		return opts.Command, nil
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd, nil
+}
+
+// Handoff 新进程从旧进程收到的listener及连接, 由InheritHandoff返回
+type Handoff struct {
+	Listener net.Listener
+	Conns    []HandoffConn
+}
+
+// HandoffConn 从旧进程收到的连接
+type HandoffConn struct {
+	Conn     net.Conn
+	Metadata []byte // HandoffOptions.Metadata返回的数据
+}
+
+// handoffMessage 旧进程发送给新进程的消息, 除handoffDone外都附带一个文件描述符
+type handoffMessage struct {
+	Kind     string `json:"kind"`
+	Unread   []byte `json:"unread,omitempty"`
+	Metadata []byte `json:"metadata,omitempty"`
+}
+
+const (
+	handoffListener = "listener"
+	handoffConn     = "conn"
+	handoffDone     = "done"
+)
+
+// handoffState 连接交给其它进程时的状态
+type handoffState struct {
+	metadata func(*Connection) []byte // 在loop中调用
+	pending  []byte                   // 因ReceiveDataChan已满没有传递的数据包
+
+	mutex     sync.Mutex
+	detached  bool // loop已停止收发
+	abandoned bool // detach超时, loop停止收发后断开连接
+
+	// loop退出后只读
+	unread []byte
+	sent   []byte // metadata的返回值
+
+	received []byte // 新进程中从旧进程收到的metadata
+}
+
+// HandoffMetadata 返回旧进程交出连接时HandoffOptions.Metadata返回的数据, 不是从旧进程收到的连接返回nil
+func (c *Connection) HandoffMetadata() []byte {
+	return c.handoff.received
+}
+
+// detach 发送完队列中的数据后停止收发, 返回复制的文件描述符及已读取但还没有处理的数据.
+// 连接的底层socket不会关闭, 由调用者在交接结束后通知断开. deadline前loop没有停止时,
+// 连接在loop停止后以ErrHandoffTimeout断开, 返回ErrHandoffTimeout
+func (c *Connection) detach(metadata func(*Connection) []byte, deadline time.Time) (*os.File, *handoffState, error) {
+	fc, ok := c.conn.(interface {
+		File() (*os.File, error)
+	})
+	if !ok || c.poll != nil {
+		return nil, nil, ErrHandoffNotSupported
+	}
+	if _, ok := c.packetHandler.(Unreader); !ok {
+		return nil, nil, ErrHandoffNotSupported
+	}
+	if c.isClosed() {
+		return nil, nil, ErrConnClosed
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return nil, nil, ErrHandoffTimeout
+	}
+
+	f, err := fc.File()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.detachOnce.Do(func() {
+		c.handoff.metadata = metadata
+		close(c.detachCmdChan)
+	})
+	// 中断正在等待数据的Receive, 最迟在包处理器的读超时后返回
+	c.conn.SetReadDeadline(time.Now())
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-c.exitChan:
+	case <-timer.C:
+		c.handoff.mutex.Lock()
+		c.handoff.abandoned = !c.handoff.detached
+		c.handoff.mutex.Unlock()
+		if c.handoff.abandoned {
+			f.Close()
+			c.disconnect(ErrHandoffTimeout)
+			return nil, nil, ErrHandoffTimeout
+		}
+		// loop已停止收发, 正在退出
+		<-c.exitChan
+	}
+
+	if !c.handoff.detached {
+		f.Close()
+		return nil, nil, ErrConnClosed
+	}
+	return f, &c.handoff, nil
+}
+
+// onDetached 在loop中等待sendLoop发送完队列中的数据, 保存未处理的数据.
+// 断开事件由TCPServer.Handoff在交接结束后通知, detach超时时直接断开
+func (c *Connection) onDetached() {
+	<-c.sendExitChan
+
+	c.handoff.unread = c.packetHandler.(Unreader).Unread()
+	if data := c.handoff.pending; data != nil {
+		// 重新编码后放在未处理的数据之前
+		if encoder, ok := c.packetHandler.(FrameEncoder); ok {
+			if frame, err := encoder.EncodeFrame(data); err == nil {
+				c.handoff.unread = append(frame, c.handoff.unread...)
+			}
+		}
+		c.releasePacket(data)
+		c.handoff.pending = nil
+	}
+	if c.handoff.metadata != nil {
+		c.handoff.sent = c.handoff.metadata(c)
+	}
+
+	c.handoff.mutex.Lock()
+	abandoned := c.handoff.abandoned
+	c.handoff.detached = !abandoned
+	c.handoff.mutex.Unlock()
+	if abandoned {
+		c.onDisconnected(ErrHandoffTimeout)
+	}
+}
+
+// Handoff 将listener(及HandoffOptions.Conns为true时已建立的连接)交给新启动的进程, 用于不停服升级.
+// 新进程需要调用InheritHandoff及ServeHandoff. 新进程接收完成后停止accept并返回nil,
+// 之后旧进程可以调用Shutdown处理剩余的连接并退出(例如base.App.Exit). 例如
+//
+//	if err := server.Handoff(rapidnet.HandoffOptions{Conns: true}); err == nil {
+//		server.Shutdown(ctx)
+//		app.Exit()
+//	}
+//
+// 返回错误时旧进程继续accept, 但已经交出的连接不会恢复.
+// listener需要实现File() (*os.File, error), 例如*net.TCPListener及*net.UnixListener. 只支持Unix系统
+func (s *TCPServer) Handoff(opts HandoffOptions) error {
+	fl, ok := s.listener.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return ErrHandoffNotSupported
+	}
+	lf, err := fl.File()
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	cmd, err := opts.command()
+	if err != nil {
+		return err
+	}
+	conn, err := startHandoff(cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(opts.timeout())
+	conn.SetDeadline(deadline)
+
+	if err := writeHandoff(conn, &handoffMessage{Kind: handoffListener}, lf); err != nil {
+		return err
+	}
+
+	if opts.Conns {
+		var detached []*Connection
+		// 停止收发的连接在交接结束后断开, 不在调用者的goroutine中通知, 避免事件chan已满时阻塞
+		defer func() {
+			if len(detached) > 0 {
+				go func() {
+					for _, c := range detached {
+						c.onDisconnected(ErrHandedOff)
+					}
+				}()
+			}
+		}()
+
+		var conns []*Connection
+		s.conns.foreach(func(c *Connection) bool {
+			conns = append(conns, c)
+			return true
+		})
+		// 并行停止收发, 按顺序发送给新进程. 出错后不再发送, 已停止收发的连接仍在交接结束后断开
+		for i, r := range detachAll(conns, opts.Metadata, deadline) {
+			if r.err != nil {
+				if r.err == ErrHandoffTimeout && err == nil {
+					err = r.err
+				}
+				continue
+			}
+			detached = append(detached, conns[i])
+			if err == nil {
+				err = writeHandoff(conn, &handoffMessage{Kind: handoffConn, Unread: r.state.unread, Metadata: r.state.sent}, r.f)
+			}
+			r.f.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := writeHandoff(conn, &handoffMessage{Kind: handoffDone}, nil); err != nil {
+		return err
+	}
+	// 等待新进程确认
+	var ack [1]byte
+	if _, err := conn.Read(ack[:]); err != nil {
+		return err
+	}
+
+	s.Stop()
+	return nil
+}
+
+// detachResult Connection.detach的结果
+type detachResult struct {
+	f     *os.File
+	state *handoffState
+	err   error
+}
+
+// detachAll 以最多maxConcurrentDetaches个goroutine并行调用conns的detach, 返回与conns顺序相同的结果
+func detachAll(conns []*Connection, metadata func(*Connection) []byte, deadline time.Time) []detachResult {
+	results := make([]detachResult, len(conns))
+	sem := make(chan struct{}, maxConcurrentDetaches)
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(r *detachResult, c *Connection) {
+			defer wg.Done()
+			r.f, r.state, r.err = c.detach(metadata, deadline)
+			<-sem
+		}(&results[i], c)
+	}
+	wg.Wait()
+	return results
+}
+
+// InheritHandoff 返回旧进程通过TCPServer.Handoff交出的listener及连接, 当前进程不是由Handoff启动时返回nil, nil
+func InheritHandoff() (*Handoff, error) {
+	fd := os.Getenv(handoffEnv)
+	if fd == "" {
+		return nil, nil
+	}
+	os.Unsetenv(handoffEnv)
+
+	conn, err := inheritHandoff(fd)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	h := &Handoff{}
+	for {
+		msg, f, err := readHandoff(conn)
+		if err != nil {
+			h.close()
+			return nil, err
+		}
+
+		switch msg.Kind {
+		case handoffListener:
+			h.Listener, err = net.FileListener(f)
+		case handoffConn:
+			var c net.Conn
+			if c, err = net.FileConn(f); err == nil {
+				if len(msg.Unread) > 0 {
+					c = &unreadConn{Conn: c, unread: msg.Unread}
+				}
+				h.Conns = append(h.Conns, HandoffConn{Conn: c, Metadata: msg.Metadata})
+			}
+		case handoffDone:
+			if h.Listener == nil {
+				h.close()
+				return nil, ErrHandoffNotSupported
+			}
+			if _, err := conn.Write([]byte{1}); err != nil {
+				h.close()
+				return nil, err
+			}
+			return h, nil
+		}
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			h.close()
+			return nil, err
+		}
+	}
+}
+
+func (h *Handoff) close() {
+	if h.Listener != nil {
+		h.Listener.Close()
+	}
+	for _, c := range h.Conns {
+		c.Conn.Close()
+	}
+}
+
+// ServeHandoff 在旧进程交出的listener上接受连接, 并继续处理旧进程交出的连接
+func (s *TCPServer) ServeHandoff(h *Handoff, maxClientsAllowed uint32) (<-chan *Event, error) {
+	eventChan, err := s.Serve(h.Listener, maxClientsAllowed)
+	if err != nil {
+		return nil, err
+	}
+	s.adopt(h.Conns)
+	return eventChan, nil
+}
+
+// ServeHandoffWithHandler 与ServeHandoff相同, 连接事件及收到的数据通过handler回调通知
+func (s *TCPServer) ServeHandoffWithHandler(h *Handoff, maxClientsAllowed uint32, handler Handler) error {
+	if err := s.ServeWithHandler(h.Listener, maxClientsAllowed, handler); err != nil {
+		return err
+	}
+	s.adopt(h.Conns)
+	return nil
+}
+
+// adopt 为旧进程交出的连接创建Connection, 与新accept的连接一样检查连接数及AcceptFilter等限制
+func (s *TCPServer) adopt(conns []HandoffConn) {
+	for _, hc := range conns {
+		addr := hc.Conn.RemoteAddr()
+		if err := s.admit(addr); err != nil {
+			s.rejectConn(hc.Conn, err)
+			continue
+		}
+		if !s.conns.tryAcquire() {
+			s.limiter.done(addr)
+			s.rejectConn(hc.Conn, ErrServerFull)
+			continue
+		}
+		// 未处理的数据交给包处理器, 连接保持原来的类型, 可以使用writev、EventLoops模式及再次交出
+		conn, unread := hc.Conn, []byte(nil)
+		if uc, ok := conn.(*unreadConn); ok {
+			conn, unread = uc.Conn, uc.unread
+		}
+		s.newConnection(conn, hc.Metadata, unread)
+	}
+}
+
+// unreadConn 先读取旧进程已读取但还没有处理的数据. ServeHandoff使用原来的连接, 由包处理器处理这些数据
+type unreadConn struct {
+	net.Conn
+	unread []byte
+}
+
+func (c *unreadConn) Read(b []byte) (int, error) {
+	if len(c.unread) > 0 {
+		n := copy(b, c.unread)
+		c.unread = c.unread[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,26 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package rapidnet
+
+import (
+	"net"
+	"os"
+	"os/exec"
+)
+
+func startHandoff(cmd *exec.Cmd) (*net.UnixConn, error) {
+	return nil, ErrHandoffNotSupported
+}
+
+func inheritHandoff(fd string) (*net.UnixConn, error) {
+	return nil, ErrHandoffNotSupported
+}
+
+func writeHandoff(conn *net.UnixConn, msg *handoffMessage, f *os.File) error {
+	return ErrHandoffNotSupported
+}
+
+func readHandoff(conn *net.UnixConn) (*handoffMessage, *os.File, error) {
+	return nil, nil, ErrHandoffNotSupported
+}
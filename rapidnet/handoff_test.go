@@ -0,0 +1,234 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package rapidnet
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// handoffChild 在Handoff启动的测试进程中运行, 回复"child:"+data, 从旧进程收到的连接回复metadata+":"+data
+func handoffChild(h *Handoff) {
+	server := CreateTCPServer()
+	events, err := server.ServeHandoff(h, 10)
+	if err != nil {
+		os.Exit(1)
+	}
+	for event := range events {
+		if event.Type != EventConnected {
+			continue
+		}
+		go func(conn *Connection) {
+			prefix := "child"
+			if metadata := conn.HandoffMetadata(); metadata != nil {
+				prefix = string(metadata)
+			}
+			for data := range conn.ReceiveDataChan() {
+				conn.Send(append([]byte(prefix+":"), data...))
+			}
+		}(event.Conn)
+	}
+}
+
+func TestTCPServer_Handoff(t *testing.T) {
+	h, err := InheritHandoff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != nil {
+		handoffChild(h)
+		return
+	}
+
+	server := CreateTCPServer()
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := server.Addr().String()
+
+	client1 := CreateTCPClientWithConfig(&Config{SendQueueSize: 64})
+	conn1, _, err := client1.Connect(addr, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Disconnect()
+
+	event := <-serverEvents
+	if event.Type != EventConnected {
+		t.Fatal("expect EventConnected, got", event.Type)
+	}
+	serverConn := event.Conn
+	conn1.Send([]byte("a"))
+	if data := <-serverConn.ReceiveDataChan(); string(data) != "a" {
+		t.Fatalf("got %q, want %q", data, "a")
+	}
+
+	// ReceiveDataChan已满时deliver等待中的数据包交给新进程
+	const count = 20
+	for i := 0; i < count; i++ {
+		conn1.Send([]byte(fmt.Sprint(i)))
+	}
+	for i := 0; i < 100 && len(serverConn.ReceiveDataChan()) < cap(serverConn.ReceiveDataChan()); i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestTCPServer_Handoff$")
+	cmd.Stderr = os.Stderr
+	err = server.Handoff(HandoffOptions{
+		Command:  cmd,
+		Conns:    true,
+		Metadata: func(*Connection) []byte { return []byte("meta") },
+		Timeout:  10 * time.Second,
+	})
+	if cmd.Process != nil {
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+	}
+	if err != nil {
+		t.Fatal("Handoff:", err)
+	}
+
+	event = <-serverEvents
+	if event.Type != EventDisconnected || event.Err != ErrHandedOff {
+		t.Fatal("unexpected event:", event.Type, event.Err)
+	}
+
+	// 已放入ReceiveDataChan的数据包由旧进程处理, 其余的由新进程按顺序处理
+	next := 0
+	for data := range serverConn.ReceiveDataChan() {
+		if want := fmt.Sprint(next); string(data) != want {
+			t.Fatalf("got %q, want %q", data, want)
+		}
+		next++
+	}
+	conn1.Send([]byte("b"))
+	for ; next <= count; next++ {
+		want := fmt.Sprint("meta:", next)
+		if next == count {
+			want = "meta:b"
+		}
+		select {
+		case data := <-conn1.ReceiveDataChan():
+			if string(data) != want {
+				t.Fatalf("got %q, want %q", data, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	// 新连接由新进程accept
+	client2 := CreateTCPClient()
+	conn2, _, err := client2.Connect(addr, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Disconnect()
+	conn2.Send([]byte("c"))
+	select {
+	case data := <-conn2.ReceiveDataChan():
+		if string(data) != "child:c" {
+			t.Fatalf("got %q, want %q", data, "child:c")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestTCPServer_ServeHandoffUnread(t *testing.T) {
+	frame := func(data string) []byte {
+		p, _ := DefaultLengthFieldSpec.appendHeader(nil, len(data))
+		return append(p, data...)
+	}
+
+	for _, loops := range []int{0, 1} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		inherited, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 旧进程已读取了"a"及"b"的包头, 其余的数据由新进程从连接读取
+		a, b := frame("a"), frame("b")
+		unread := append(a, b[:2]...)
+		server := CreateTCPServerWithConfig(&Config{EventLoops: loops})
+		serverEvents, err := server.ServeHandoff(&Handoff{
+			Listener: ln,
+			Conns:    []HandoffConn{{Conn: &unreadConn{Conn: inherited, unread: unread}, Metadata: []byte("m")}},
+		}, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Stop()
+
+		conn := waitEvent(t, serverEvents, EventConnected).Conn
+		// 连接保持原来的类型, 可以使用writev及EventLoops模式, 并再次交出
+		if _, ok := conn.conn.(*net.TCPConn); !ok {
+			t.Fatalf("EventLoops %d: unexpected conn type %T", loops, conn.conn)
+		}
+		client.Write(b[2:])
+		for _, want := range []string{"a", "b"} {
+			select {
+			case data := <-conn.ReceiveDataChan():
+				if string(data) != want {
+					t.Fatalf("EventLoops %d: got %q, want %q", loops, data, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout")
+			}
+		}
+	}
+}
+
+func TestConnection_DetachAll(t *testing.T) {
+	server := CreateTCPServer()
+	serverEvents, err := server.Start("127.0.0.1:0", 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	var conns []*Connection
+	for i := 0; i < 10; i++ {
+		client, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Disconnect()
+		conns = append(conns, waitEvent(t, serverEvents, EventConnected).Conn)
+	}
+
+	// 每个连接停止收发需要100ms, 依次停止时会超时
+	metadata := func(*Connection) []byte {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}
+	for i, r := range detachAll(conns, metadata, time.Now().Add(500*time.Millisecond)) {
+		if r.err != nil {
+			t.Fatal("detach:", i, r.err)
+		}
+		r.f.Close()
+		go conns[i].onDisconnected(ErrHandedOff)
+	}
+	for range conns {
+		if event := waitEvent(t, serverEvents, EventDisconnected); event.Err != ErrHandedOff {
+			t.Fatal("unexpected error:", event.Err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package rapidnet
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// maxHandoffMessageSize 消息的最大长度, 包括连接中未处理的数据
+const maxHandoffMessageSize = 16 << 20
+
+// startHandoff 启动新进程, 返回与新进程通信的Unix socket
+func startHandoff(cmd *exec.Cmd) (*net.UnixConn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fds[0])
+	local := os.NewFile(uintptr(fds[0]), "handoff")
+	remote := os.NewFile(uintptr(fds[1]), "handoff")
+	defer local.Close()
+	defer remote.Close()
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env, handoffEnv+"="+strconv.Itoa(3+len(cmd.ExtraFiles)))
+	cmd.ExtraFiles = append(cmd.ExtraFiles, remote)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	conn, err := net.FileConn(local)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UnixConn), nil
+}
+
+// inheritHandoff 返回与旧进程通信的Unix socket
+func inheritHandoff(fd string) (*net.UnixConn, error) {
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(n), "handoff")
+	defer f.Close()
+
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return nil, ErrHandoffNotSupported
+	}
+	return uc, nil
+}
+
+// writeHandoff 发送4字节长度及JSON编码的msg, f不为nil时附带f的文件描述符
+func writeHandoff(conn *net.UnixConn, msg *handoffMessage, f *os.File) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(b, uint32(len(body)))
+	b = append(b, body...)
+
+	var oob []byte
+	if f != nil {
+		oob = syscall.UnixRights(int(f.Fd()))
+	}
+	n, _, err := conn.WriteMsgUnix(b, oob, nil)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b[n:])
+	return err
+}
+
+// readHandoff 读取writeHandoff发送的消息及附带的文件
+func readHandoff(conn *net.UnixConn) (*handoffMessage, *os.File, error) {
+	var header [4]byte
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(header[:], oob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var f *os.File
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, m := range msgs {
+			fds, err := syscall.ParseUnixRights(&m)
+			if err != nil {
+				continue
+			}
+			for _, fd := range fds {
+				if f == nil {
+					f = os.NewFile(uintptr(fd), "handoff")
+				} else {
+					syscall.Close(fd)
+				}
+			}
+		}
+	}
+
+	msg, err := readHandoffBody(conn, header[:], n)
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, nil, err
+	}
+	if f == nil && msg.Kind != handoffDone {
+		return nil, nil, ErrHandoffNotSupported
+	}
+	return msg, f, nil
+}
+
+// readHandoffBody 读取剩余的长度及JSON编码的消息, header中已读取了n字节
+func readHandoffBody(conn *net.UnixConn, header []byte, n int) (*handoffMessage, error) {
+	if _, err := io.ReadFull(conn, header[n:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxHandoffMessageSize {
+		return nil, ErrHandoffNotSupported
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+
+	msg := &handoffMessage{}
+	if err := json.Unmarshal(body, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,477 @@
+package rapidnet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+var (
+	// ErrInvalidTag 包头标记不匹配
+	ErrInvalidTag = errors.New("rapidnet: invalid data")
+
+	// ErrFrameTooLarge 数据包超过最大长度
+	ErrFrameTooLarge = errors.New("rapidnet: too large")
+
+	// ErrInvalidLength 长度字段的值不合法
+	ErrInvalidLength = errors.New("rapidnet: invalid length")
+
+	// ErrChecksum 校验和不匹配
+	ErrChecksum = errors.New("rapidnet: checksum mismatch")
+)
+
+// 等待数据时的读超时, 超时后Receive返回nil, nil, 以便连接检查是否需要退出
+const receiveTimeout = time.Second * 2
+
+// 校验和的字节数
+const checksumSize = 4
+
+const (
+	// 缓存的数据超过此字节数时, Send不等待Flush直接写入连接
+	flushThreshold = 64 * 1024
+
+	// 保存缓存的包头及校验和的数组大小
+	scratchSize = 512
+)
+
+// LengthFieldSpec 描述长度前缀的封包格式:
+//
+//	| Tag | Length | Body | Checksum |
+//
+// Tag及Checksum是可选的.
+type LengthFieldSpec struct {
+	// Tag 包头标记, 为空时没有标记
+	Tag []byte
+
+	// LengthSize 长度字段的字节数, 可以是1, 2, 4, 8
+	LengthSize int
+
+	// ByteOrder 长度字段及校验和的字节序, 为nil时使用小端
+	ByteOrder binary.ByteOrder
+
+	// LengthIncludesHeader 长度字段的值是否包含包头(Tag及Length)的长度
+	LengthIncludesHeader bool
+
+	// LengthAdjustment 长度字段的值 = Body的长度 + LengthAdjustment (+ 包头长度)
+	LengthAdjustment int
+
+	// MaxFrameSize Body的最大长度, 为0时只受长度字段的大小限制
+	MaxFrameSize int
+
+	// Checksum 可选的校验和函数, 例如crc32.ChecksumIEEE.
+	// 设置后, 4字节的校验和附加在Body之后
+	Checksum func([]byte) uint32
+}
+
+// DefaultLengthFieldSpec 默认的封包格式: 0xFEDC标记, 2字节小端长度, Body最大64KB
+var DefaultLengthFieldSpec = LengthFieldSpec{
+	Tag:          []byte{0xFE, 0xDC},
+	LengthSize:   2,
+	ByteOrder:    binary.LittleEndian,
+	MaxFrameSize: 0xFFFF,
+}
+
+// HeaderSize 返回包头的字节数
+func (spec *LengthFieldSpec) HeaderSize() int {
+	return len(spec.Tag) + spec.LengthSize
+}
+
+func (spec *LengthFieldSpec) byteOrder() binary.ByteOrder {
+	if spec.ByteOrder == nil {
+		return binary.LittleEndian
+	}
+	return spec.ByteOrder
+}
+
+func (spec *LengthFieldSpec) adjustment() int {
+	if spec.LengthIncludesHeader {
+		return spec.LengthAdjustment + spec.HeaderSize()
+	}
+	return spec.LengthAdjustment
+}
+
+func (spec *LengthFieldSpec) trailerSize() int {
+	if spec.Checksum != nil {
+		return checksumSize
+	}
+	return 0
+}
+
+// maxFrameSize 返回Body的最大长度
+func (spec *LengthFieldSpec) maxFrameSize() int {
+	max := maxInt
+	if spec.LengthSize < 8 {
+		if m := uint64(1)<<(uint(spec.LengthSize)*8) - 1; m < uint64(maxInt) {
+			max = int(m)
+		}
+		max -= spec.adjustment()
+	}
+	if spec.MaxFrameSize > 0 && spec.MaxFrameSize < max {
+		max = spec.MaxFrameSize
+	}
+	return max
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+// decodeHeader 解析包头, 返回Body的长度
+func (spec *LengthFieldSpec) decodeHeader(p []byte) (int, error) {
+	for i, b := range spec.Tag {
+		if p[i] != b {
+			return 0, ErrInvalidTag
+		}
+	}
+	p = p[len(spec.Tag):]
+
+	var v uint64
+	order := spec.byteOrder()
+	switch spec.LengthSize {
+	case 1:
+		v = uint64(p[0])
+	case 2:
+		v = uint64(order.Uint16(p))
+	case 4:
+		v = uint64(order.Uint32(p))
+	case 8:
+		v = order.Uint64(p)
+	}
+	if v > uint64(maxInt) {
+		return 0, ErrFrameTooLarge
+	}
+
+	n := int(v) - spec.adjustment()
+	if n < 0 {
+		return 0, ErrInvalidLength
+	}
+	if n > spec.maxFrameSize() {
+		return 0, ErrFrameTooLarge
+	}
+	return n, nil
+}
+
+// appendHeader 将n字节Body的包头添加到dst之后
+func (spec *LengthFieldSpec) appendHeader(dst []byte, n int) ([]byte, error) {
+	if n > spec.maxFrameSize() {
+		return dst, ErrFrameTooLarge
+	}
+	v := n + spec.adjustment()
+	if v < 0 {
+		return dst, ErrInvalidLength
+	}
+
+	dst = append(dst, spec.Tag...)
+	// 直接写入dst, 避免临时数组经由ByteOrder接口逃逸到堆上
+	var zero [8]byte
+	dst = append(dst, zero[:spec.LengthSize]...)
+	b := dst[len(dst)-spec.LengthSize:]
+	order := spec.byteOrder()
+	switch spec.LengthSize {
+	case 1:
+		b[0] = byte(v)
+	case 2:
+		order.PutUint16(b, uint16(v))
+	case 4:
+		order.PutUint32(b, uint32(v))
+	case 8:
+		order.PutUint64(b, uint64(v))
+	}
+	return dst, nil
+}
+
+func (spec *LengthFieldSpec) validate() error {
+	switch spec.LengthSize {
+	case 1, 2, 4, 8:
+	default:
+		return errors.New("rapidnet: LengthSize must be 1, 2, 4 or 8")
+	}
+	if spec.maxFrameSize() < 0 {
+		return errors.New("rapidnet: invalid LengthAdjustment")
+	}
+	return nil
+}
+
+// LengthFieldPacketHandler 按LengthFieldSpec描述的格式读写数据包
+type LengthFieldPacketHandler struct {
+	spec      *LengthFieldSpec // 由同一个factory创建的包处理器共享, 作为FrameFormat
+	conn      net.Conn
+	bufReader *bufio.Reader
+	restored  *bytes.Reader // Restore设置的数据中还没有读入bufReader的部分
+	vectored  bool          // conn支持writev
+
+	scratch     []byte      // 等待发送的包头及校验和
+	vec         net.Buffers // 等待发送的包头, 数据及校验和
+	pending     int         // 等待发送的字节数
+	data        []byte      // 正在读取的Body及校验和
+	readed      int
+	headerReady bool
+
+	maxPacketSize int // 为0时只受spec.MaxFrameSize限制
+}
+
+// NewLengthFieldPacketHandler 创建LengthFieldPacketHandler. spec不合法时panic
+func NewLengthFieldPacketHandler(conn net.Conn, spec LengthFieldSpec) *LengthFieldPacketHandler {
+	if err := spec.validate(); err != nil {
+		panic(err)
+	}
+	return newLengthFieldPacketHandler(conn, &spec)
+}
+
+func newLengthFieldPacketHandler(conn net.Conn, spec *LengthFieldSpec) *LengthFieldPacketHandler {
+	return &LengthFieldPacketHandler{
+		spec:      spec,
+		conn:      conn,
+		bufReader: bufio.NewReader(conn),
+		vectored:  isVectored(conn),
+	}
+}
+
+// isVectored conn写入net.Buffers时是否使用writev一次写入
+func isVectored(conn net.Conn) bool {
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// NewLengthFieldPacketHandlerFactory 返回可用于Config.PacketHandlerFactory的函数. spec不合法时panic
+func NewLengthFieldPacketHandlerFactory(spec LengthFieldSpec) func(net.Conn) PacketHandler {
+	if err := spec.validate(); err != nil {
+		panic(err)
+	}
+	return func(conn net.Conn) PacketHandler {
+		return newLengthFieldPacketHandler(conn, &spec)
+	}
+}
+
+// PooledPackets 返回的数据包从缓冲池中分配
+func (obj *LengthFieldPacketHandler) PooledPackets() bool {
+	return true
+}
+
+// SetMaxPacketSize 设置数据包的最大长度, 解码包头时检查, 超过时返回ErrPacketTooLarge. 为0时不限制
+func (obj *LengthFieldPacketHandler) SetMaxPacketSize(n int) {
+	obj.maxPacketSize = n
+}
+
+// decodeHeader 解码包头, 返回数据的长度
+func (obj *LengthFieldPacketHandler) decodeHeader(p []byte) (int, error) {
+	n, err := obj.spec.decodeHeader(p)
+	if err == nil && obj.maxPacketSize > 0 && n > obj.maxPacketSize {
+		return 0, ErrPacketTooLarge
+	}
+	return n, err
+}
+
+// Receive 读取一个数据包. 在读超时前没有读到完整的数据包时返回nil, nil.
+// 数据包从缓冲池中分配, 上层可以通过Packet.Release归还
+func (obj *LengthFieldPacketHandler) Receive() ([]byte, error) {
+	if !obj.headerReady {
+		// 读取header
+		obj.conn.SetReadDeadline(time.Now().Add(receiveTimeout))
+		headerSize := obj.spec.HeaderSize()
+		p, err := obj.bufReader.Peek(headerSize)
+		if err != nil {
+			return nil, ignoreTimeout(err)
+		}
+
+		dataLen, err := obj.decodeHeader(p)
+		if err != nil {
+			return nil, err
+		}
+
+		obj.bufReader.Discard(headerSize)
+		obj.headerReady = true
+		obj.data = NewPacket(dataLen + obj.spec.trailerSize())
+		obj.readed = 0
+	}
+
+	// read body
+	obj.conn.SetReadDeadline(time.Now().Add(receiveTimeout))
+	for obj.readed < len(obj.data) {
+		n, err := obj.bufReader.Read(obj.data[obj.readed:])
+		obj.readed += n
+		if err != nil {
+			return nil, ignoreTimeout(err)
+		}
+	}
+
+	p := obj.data
+	obj.data = nil
+	obj.readed = 0
+	obj.headerReady = false
+
+	if obj.spec.Checksum != nil {
+		body := p[:len(p)-checksumSize]
+		if obj.spec.byteOrder().Uint32(p[len(body):]) != obj.spec.Checksum(body) {
+			Packet(p).Release()
+			return nil, ErrChecksum
+		}
+		p = body
+	}
+	return p, nil
+}
+
+// Unread 返回已从连接读取但还没有返回的数据, 包括已读取包头的不完整数据包(重新编码包头)及缓存的数据
+func (obj *LengthFieldPacketHandler) Unread() []byte {
+	var p []byte
+	if obj.headerReady {
+		p, _ = obj.spec.appendHeader(p, len(obj.data)-obj.spec.trailerSize())
+		p = append(p, obj.data[:obj.readed]...)
+		Packet(obj.data).Release()
+		obj.data = nil
+		obj.readed = 0
+		obj.headerReady = false
+	}
+	buffered, _ := obj.bufReader.Peek(obj.bufReader.Buffered())
+	p = append(p, buffered...)
+	obj.bufReader.Discard(len(buffered))
+	if obj.restored != nil {
+		rest, _ := ioutil.ReadAll(obj.restored)
+		p = append(p, rest...)
+	}
+	return p
+}
+
+// Restore 设置旧进程交出连接时已读取但还没有处理的数据, 之后先从data中接收数据包
+func (obj *LengthFieldPacketHandler) Restore(data []byte) {
+	obj.restored = bytes.NewReader(data)
+	obj.bufReader.Reset(io.MultiReader(obj.restored, obj.conn))
+}
+
+// Send 将一个数据包写入缓存, Flush时写入连接. 缓存的数据超过flushThreshold时立即写入
+func (obj *LengthFieldPacketHandler) Send(data []byte) error {
+	// 包头及校验和保存在scratch中, 空间不足时分配新的scratch, 已缓存的切片仍然引用原来的数组
+	need := obj.spec.HeaderSize() + obj.spec.trailerSize()
+	if cap(obj.scratch)-len(obj.scratch) < need {
+		size := scratchSize
+		if size < need {
+			size = need
+		}
+		obj.scratch = make([]byte, 0, size)
+	}
+
+	start := len(obj.scratch)
+	scratch, err := obj.spec.appendHeader(obj.scratch, len(data))
+	if err != nil {
+		return err
+	}
+	obj.vec = append(obj.vec, scratch[start:], data)
+
+	if obj.spec.Checksum != nil {
+		start = len(scratch)
+		scratch = scratch[:start+checksumSize]
+		obj.spec.byteOrder().PutUint32(scratch[start:], obj.spec.Checksum(data))
+		obj.vec = append(obj.vec, scratch[start:])
+	}
+	obj.scratch = scratch
+
+	obj.pending += need + len(data)
+	if obj.pending >= flushThreshold {
+		return obj.Flush()
+	}
+	return nil
+}
+
+// Flush 将缓存的数据写入连接. conn支持writev时通过一次系统调用写入, 否则合并到一个缓冲区后写入
+func (obj *LengthFieldPacketHandler) Flush() error {
+	if len(obj.vec) == 0 {
+		return nil
+	}
+
+	// WriteTo会移动obj.vec的起始位置, 先保留原来的切片以便重复使用数组
+	sent := obj.vec
+	var err error
+	if obj.vectored {
+		_, err = obj.vec.WriteTo(obj.conn)
+	} else {
+		frame := NewPacket(obj.pending)[:0]
+		for _, b := range obj.vec {
+			frame = append(frame, b...)
+		}
+		_, err = obj.conn.Write(frame)
+		Packet(frame).Release()
+	}
+
+	// 不再引用已发送的数据
+	for i := range sent {
+		sent[i] = nil
+	}
+	obj.vec = sent[:0]
+	obj.scratch = obj.scratch[:0]
+	obj.pending = 0
+
+	if err != nil {
+		obj.conn.Close()
+	}
+	return err
+}
+
+// EncodeFrame 将数据编码为包含包头及校验和的完整帧
+func (obj *LengthFieldPacketHandler) EncodeFrame(data []byte) ([]byte, error) {
+	frame := make([]byte, 0, obj.spec.HeaderSize()+len(data)+obj.spec.trailerSize())
+	frame, err := obj.spec.appendHeader(frame, len(data))
+	if err != nil {
+		return nil, err
+	}
+
+	frame = append(frame, data...)
+	if obj.spec.Checksum != nil {
+		var sum [checksumSize]byte
+		obj.spec.byteOrder().PutUint32(sum[:], obj.spec.Checksum(data))
+		frame = append(frame, sum[:]...)
+	}
+	return frame, nil
+}
+
+// FrameFormat 返回封包格式的标识. 由同一个NewLengthFieldPacketHandlerFactory创建的包处理器共享编码后的帧
+func (obj *LengthFieldPacketHandler) FrameFormat() interface{} {
+	return obj.spec
+}
+
+// SendFrame 将EncodeFrame编码的帧写入缓存, Flush时写入连接
+func (obj *LengthFieldPacketHandler) SendFrame(frame []byte) error {
+	obj.vec = append(obj.vec, frame)
+	obj.pending += len(frame)
+	if obj.pending >= flushThreshold {
+		return obj.Flush()
+	}
+	return nil
+}
+
+// DecodeFrame 从buf中解码一个数据包, 用于EventLoops模式. 数据包从缓冲池中分配
+func (obj *LengthFieldPacketHandler) DecodeFrame(buf []byte) ([]byte, int, error) {
+	headerSize := obj.spec.HeaderSize()
+	if len(buf) < headerSize {
+		return nil, 0, nil
+	}
+	dataLen, err := obj.decodeHeader(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	n := headerSize + dataLen + obj.spec.trailerSize()
+	if len(buf) < n {
+		return nil, 0, nil
+	}
+
+	body := buf[headerSize : headerSize+dataLen]
+	if obj.spec.Checksum != nil && obj.spec.byteOrder().Uint32(buf[headerSize+dataLen:]) != obj.spec.Checksum(body) {
+		return nil, 0, ErrChecksum
+	}
+	p := NewPacket(dataLen)
+	copy(p, body)
+	return p, n, nil
+}
+
+// ignoreTimeout 读超时不作为错误
+func ignoreTimeout(err error) error {
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+package rapidnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLengthFieldPacketHandler(t *testing.T) {
+	specs := []LengthFieldSpec{
+		DefaultLengthFieldSpec,
+		{LengthSize: 1},
+		{Tag: []byte{0xFE, 0xDC}, LengthSize: 4, ByteOrder: binary.LittleEndian, MaxFrameSize: 0x7FFFFFFF},
+		{LengthSize: 8, ByteOrder: binary.BigEndian, LengthIncludesHeader: true},
+		{Tag: []byte{0xAB}, LengthSize: 2, ByteOrder: binary.BigEndian, Checksum: crc32.ChecksumIEEE},
+	}
+
+	for _, spec := range specs {
+		c1, c2 := net.Pipe()
+		sender := NewLengthFieldPacketHandler(c1, spec)
+		receiver := NewLengthFieldPacketHandler(c2, spec)
+
+		packets := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{1}, 200)}
+		go func() {
+			for _, p := range packets {
+				if err := sender.Send(p); err != nil {
+					t.Error(err)
+				}
+			}
+			if err := sender.Flush(); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		for _, p := range packets {
+			var data []byte
+			var err error
+			for data == nil && err == nil {
+				data, err = receiver.Receive()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, p) {
+				t.Fatalf("spec %+v: got %v, want %v", spec, data, p)
+			}
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestLengthFieldSpec_Header(t *testing.T) {
+	spec := DefaultLengthFieldSpec
+	header, err := spec.appendHeader(nil, 0x0102)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(header, []byte{0xFE, 0xDC, 0x02, 0x01}) {
+		t.Fatal("unexpected header:", header)
+	}
+
+	if _, err := spec.appendHeader(nil, 0x10000); err != ErrFrameTooLarge {
+		t.Fatal("expect ErrFrameTooLarge, got", err)
+	}
+	if _, err := spec.decodeHeader([]byte{0xFE, 0xDD, 0, 0}); err != ErrInvalidTag {
+		t.Fatal("expect ErrInvalidTag, got", err)
+	}
+
+	spec = LengthFieldSpec{LengthSize: 2, ByteOrder: binary.BigEndian, LengthIncludesHeader: true}
+	if n, err := spec.decodeHeader([]byte{0, 7}); err != nil || n != 5 {
+		t.Fatal("unexpected length:", n, err)
+	}
+	if _, err := spec.decodeHeader([]byte{0, 1}); err != ErrInvalidLength {
+		t.Fatal("expect ErrInvalidLength, got", err)
+	}
+}
+
+func TestLengthFieldPacketHandler_Tag(t *testing.T) {
+	receive := func(input []byte) ([]byte, error) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		go c1.Write(input)
+
+		h := NewLengthFieldPacketHandler(c2, DefaultLengthFieldSpec)
+		for {
+			data, err := h.Receive()
+			if data != nil || err != nil {
+				return data, err
+			}
+		}
+	}
+
+	if _, err := receive([]byte{0, 1, 0, 1, 2}); err != ErrInvalidTag {
+		t.Fatal("expect ErrInvalidTag, got", err)
+	}
+
+	data, err := receive([]byte{0xfe, 0xdc, 3, 0, 0, 1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte{0, 1, 2}) {
+		t.Fatal("unexpected data:", data)
+	}
+}
+
+func TestLengthFieldPacketHandler_Restore(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	sender := NewLengthFieldPacketHandler(c1, DefaultLengthFieldSpec)
+	var unread []byte
+	for i := 0; i < 3; i++ {
+		frame, err := sender.EncodeFrame(bytes.Repeat([]byte{byte(i)}, 3000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		unread = append(unread, frame...)
+	}
+
+	// 超过读缓冲区的数据在Unread时与缓冲区中的数据一起返回
+	h := NewLengthFieldPacketHandler(c2, DefaultLengthFieldSpec)
+	h.Restore(unread)
+	data, err := h.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, bytes.Repeat([]byte{0}, 3000)) {
+		t.Fatal("unexpected data")
+	}
+	if rest := h.Unread(); !bytes.Equal(rest, unread[len(unread)/3:]) {
+		t.Fatal("unexpected unread data:", len(rest))
+	}
+}
+
+// benchConn 循环读出同一段数据, 写入的数据被丢弃
+type benchConn struct {
+	net.Conn
+	data []byte
+	off  int
+}
+
+func (c *benchConn) Read(p []byte) (int, error) {
+	n := copy(p, c.data[c.off:])
+	c.off = (c.off + n) % len(c.data)
+	return n, nil
+}
+
+func (c *benchConn) Write(p []byte) (int, error)       { return len(p), nil }
+func (c *benchConn) SetReadDeadline(t time.Time) error { return nil }
+func (c *benchConn) Close() error                      { return nil }
+
+func BenchmarkLengthFieldPacketHandler_Receive(b *testing.B) {
+	frame, _ := NewLengthFieldPacketHandler(nil, DefaultLengthFieldSpec).EncodeFrame(make([]byte, 1000))
+
+	for _, release := range []bool{false, true} {
+		name := "NoRelease"
+		if release {
+			name = "Release"
+		}
+		b.Run(name, func(b *testing.B) {
+			h := NewLengthFieldPacketHandler(&benchConn{data: frame}, DefaultLengthFieldSpec)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(frame)))
+			for i := 0; i < b.N; i++ {
+				data, err := h.Receive()
+				if err != nil || len(data) != 1000 {
+					b.Fatal(len(data), err)
+				}
+				if release {
+					Packet(data).Release()
+				}
+			}
+		})
+	}
+}
+
+// benchmarkSend 发送b.N个数据包, 每batch个数据包flush一次
+func benchmarkSend(b *testing.B, conn net.Conn, batch int) {
+	data := make([]byte, 1000)
+	h := NewLengthFieldPacketHandler(conn, DefaultLengthFieldSpec)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 1; i <= b.N; i++ {
+		if err := h.Send(data); err != nil {
+			b.Fatal(err)
+		}
+		if i%batch == 0 || i == b.N {
+			if err := h.Flush(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkLengthFieldPacketHandler_Send(b *testing.B) {
+	b.Run("Buffer", func(b *testing.B) { benchmarkSend(b, &benchConn{}, 1) })
+	b.Run("BufferBatch16", func(b *testing.B) { benchmarkSend(b, &benchConn{}, 16) })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	for _, batch := range []int{1, 16} {
+		b.Run(fmt.Sprintf("Writev/Batch%d", batch), func(b *testing.B) {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			benchmarkSend(b, conn, batch)
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package rapidnet
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AcceptLimits 服务器接受连接时的限制, 在连接登记到服务器之前检查.
+// 无法解析出IP的地址(例如Unix socket)不受限制
+type AcceptLimits struct {
+	// MaxConnsPerIP 每个IP同时存在的最大连接数, 为0时不限制
+	MaxConnsPerIP int
+
+	// CIDRLimits 每个网段同时存在的最大连接数, 同一网段内的所有IP共享上限
+	CIDRLimits []CIDRLimit
+
+	// ConnectRate 每个IP每秒允许新建的连接数(令牌桶), 为0时不限制
+	ConnectRate float64
+
+	// ConnectBurst 令牌桶的容量, 即每个IP允许突发新建的连接数, 为0时为1
+	ConnectBurst int
+}
+
+// CIDRLimit 网段的最大连接数
+type CIDRLimit struct {
+	Network  *net.IPNet
+	MaxConns int
+}
+
+// 令牌桶长时间已满的IP会被清理
+const tokenBucketSweepInterval = time.Minute
+
+// tokenBucket 令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill 按经过的时间补充令牌, 不超过burst
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// wait 返回令牌数达到n需要等待的时间
+func (b *tokenBucket) wait(n, rate float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / rate * float64(time.Second))
+}
+
+// acceptLimiter 按AcceptLimits统计每个IP及网段的连接数和新建连接的速率
+type acceptLimiter struct {
+	limits AcceptLimits
+
+	mutex      sync.Mutex
+	ipCounts   map[string]int
+	cidrCounts []int
+	buckets    map[string]*tokenBucket
+	lastSweep  time.Time
+}
+
+// newAcceptLimiter 创建限制器, 没有设置限制时返回nil
+func newAcceptLimiter(limits *AcceptLimits) *acceptLimiter {
+	if limits == nil || (limits.MaxConnsPerIP <= 0 && len(limits.CIDRLimits) == 0 && limits.ConnectRate <= 0) {
+		return nil
+	}
+	return &acceptLimiter{
+		limits:     *limits,
+		ipCounts:   make(map[string]int),
+		cidrCounts: make([]int, len(limits.CIDRLimits)),
+		buckets:    make(map[string]*tokenBucket),
+		lastSweep:  time.Now(),
+	}
+}
+
+// addrIP 返回addr的IP, 无法解析时返回nil
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// admit 检查addr是否允许建立新连接, 允许时计入连接数, 连接结束后需要调用done
+func (l *acceptLimiter) admit(addr net.Addr) error {
+	if l == nil {
+		return nil
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return nil
+	}
+	key := ip.String()
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var bucket *tokenBucket
+	if l.limits.ConnectRate > 0 {
+		l.sweep(now)
+		bucket = l.buckets[key]
+		if bucket == nil {
+			bucket = &tokenBucket{tokens: l.burst(), last: now}
+			l.buckets[key] = bucket
+		} else {
+			bucket.refill(now, l.limits.ConnectRate, l.burst())
+		}
+		if bucket.tokens < 1 {
+			return ErrConnectRateExceeded
+		}
+	}
+
+	if l.limits.MaxConnsPerIP > 0 && l.ipCounts[key] >= l.limits.MaxConnsPerIP {
+		return ErrTooManyConnsPerIP
+	}
+	for i, limit := range l.limits.CIDRLimits {
+		if limit.Network.Contains(ip) && l.cidrCounts[i] >= limit.MaxConns {
+			return ErrTooManyConnsPerCIDR
+		}
+	}
+
+	if bucket != nil {
+		bucket.tokens--
+	}
+	l.ipCounts[key]++
+	for i, limit := range l.limits.CIDRLimits {
+		if limit.Network.Contains(ip) {
+			l.cidrCounts[i]++
+		}
+	}
+	return nil
+}
+
+// done 连接结束, 从连接数中减去addr
+func (l *acceptLimiter) done(addr net.Addr) {
+	if l == nil {
+		return
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return
+	}
+	key := ip.String()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.ipCounts[key]--; l.ipCounts[key] <= 0 {
+		delete(l.ipCounts, key)
+	}
+	for i, limit := range l.limits.CIDRLimits {
+		if limit.Network.Contains(ip) {
+			l.cidrCounts[i]--
+		}
+	}
+}
+
+func (l *acceptLimiter) burst() float64 {
+	if l.limits.ConnectBurst > 0 {
+		return float64(l.limits.ConnectBurst)
+	}
+	return 1
+}
+
+// sweep 清理令牌桶已满的IP
+func (l *acceptLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < tokenBucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	full := time.Duration(l.burst() / l.limits.ConnectRate * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimitAction 收到数据的速率超过限制时的处理方式
+type RateLimitAction int
+
+const (
+	// RateLimitDrop 丢弃超过限制的数据包
+	RateLimitDrop RateLimitAction = iota
+
+	// RateLimitDelay 暂停读取直到速率低于限制, 对端的发送会因TCP的流量控制而变慢
+	RateLimitDelay
+
+	// RateLimitDisconnect 以ErrRateLimited断开连接
+	RateLimitDisconnect
+)
+
+// RateLimit 每个连接收到数据包的速率限制, 心跳包不计算在内
+type RateLimit struct {
+	// PacketsPerSecond 每秒允许收到的数据包数量, 为0时不限制
+	PacketsPerSecond float64
+
+	// PacketBurst 允许突发收到的数据包数量, 为0时与PacketsPerSecond相同(至少为1)
+	PacketBurst int
+
+	// BytesPerSecond 每秒允许收到的字节数, 为0时不限制
+	BytesPerSecond float64
+
+	// ByteBurst 允许突发收到的字节数, 为0时与BytesPerSecond相同.
+	// 大于ByteBurst的数据包在令牌桶已满时允许收到
+	ByteBurst int
+
+	// Action 超过限制时的处理方式, 默认为RateLimitDrop
+	Action RateLimitAction
+}
+
+// rateLimiter 按RateLimit限制一个连接收到数据的速率, 只在连接的接收goroutine中使用
+type rateLimiter struct {
+	limit   RateLimit
+	packets tokenBucket
+	bytes   tokenBucket
+}
+
+// newRateLimiter 创建限制器, 没有设置限制时返回nil
+func newRateLimiter(limit *RateLimit) *rateLimiter {
+	if limit == nil || (limit.PacketsPerSecond <= 0 && limit.BytesPerSecond <= 0) {
+		return nil
+	}
+	l := &rateLimiter{limit: *limit}
+	now := time.Now()
+	l.packets = tokenBucket{tokens: l.packetBurst(), last: now}
+	l.bytes = tokenBucket{tokens: l.byteBurst(), last: now}
+	return l
+}
+
+// take 计算收到n字节的数据包需要等待的时间, 不需要等待或force为true时扣除令牌
+func (l *rateLimiter) take(n int, now time.Time, force bool) time.Duration {
+	var d time.Duration
+	if rate := l.limit.PacketsPerSecond; rate > 0 {
+		l.packets.refill(now, rate, l.packetBurst())
+		d = l.packets.wait(1, rate)
+	}
+	if rate := l.limit.BytesPerSecond; rate > 0 {
+		burst := l.byteBurst()
+		l.bytes.refill(now, rate, burst)
+		need := float64(n)
+		if need > burst {
+			need = burst
+		}
+		if w := l.bytes.wait(need, rate); w > d {
+			d = w
+		}
+	}
+
+	if d == 0 || force {
+		l.packets.tokens--
+		l.bytes.tokens -= float64(n)
+	}
+	return d
+}
+
+func (l *rateLimiter) packetBurst() float64 {
+	if l.limit.PacketBurst > 0 {
+		return float64(l.limit.PacketBurst)
+	}
+	if l.limit.PacketsPerSecond < 1 {
+		return 1
+	}
+	return l.limit.PacketsPerSecond
+}
+
+func (l *rateLimiter) byteBurst() float64 {
+	if l.limit.ByteBurst > 0 {
+		return float64(l.limit.ByteBurst)
+	}
+	return l.limit.BytesPerSecond
+}
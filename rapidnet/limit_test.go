@@ -0,0 +1,216 @@
+package rapidnet
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcceptLimiter(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	l := newAcceptLimiter(&AcceptLimits{
+		MaxConnsPerIP: 2,
+		CIDRLimits:    []CIDRLimit{{Network: network, MaxConns: 3}},
+	})
+	addr := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1000} }
+
+	for i := 0; i < 2; i++ {
+		if err := l.admit(addr("10.0.0.1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.admit(addr("10.0.0.1")); err != ErrTooManyConnsPerIP {
+		t.Fatal("expect ErrTooManyConnsPerIP, got", err)
+	}
+	if err := l.admit(addr("10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.admit(addr("10.0.0.3")); err != ErrTooManyConnsPerCIDR {
+		t.Fatal("expect ErrTooManyConnsPerCIDR, got", err)
+	}
+	if err := l.admit(addr("10.0.1.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	l.done(addr("10.0.0.1"))
+	if err := l.admit(addr("10.0.0.3")); err != nil {
+		t.Fatal(err)
+	}
+
+	l = newAcceptLimiter(&AcceptLimits{ConnectRate: 20, ConnectBurst: 2})
+	for i := 0; i < 2; i++ {
+		if err := l.admit(addr("10.0.0.1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.admit(addr("10.0.0.1")); err != ErrConnectRateExceeded {
+		t.Fatal("expect ErrConnectRateExceeded, got", err)
+	}
+	if err := l.admit(addr("10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 60)
+	if err := l.admit(addr("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTCPServer_AcceptFilter(t *testing.T) {
+	denied := make(chan struct{}, 1)
+	server := CreateTCPServerWithConfig(&Config{
+		AcceptFilter: func(addr net.Addr) bool {
+			select {
+			case <-denied:
+				return false
+			default:
+				return true
+			}
+		},
+		AcceptLimits: &AcceptLimits{MaxConnsPerIP: 1},
+	})
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	conn, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, serverEvents, EventConnected)
+
+	rejected, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Disconnect()
+	if event := waitEvent(t, serverEvents, EventRejected); event.Err != ErrTooManyConnsPerIP {
+		t.Fatal("expect ErrTooManyConnsPerIP, got", event.Err)
+	}
+
+	conn.Disconnect()
+	waitEvent(t, serverEvents, EventDisconnected)
+
+	denied <- struct{}{}
+	filtered, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filtered.Disconnect()
+	if event := waitEvent(t, serverEvents, EventRejected); event.Err != ErrAcceptFiltered {
+		t.Fatal("expect ErrAcceptFiltered, got", event.Err)
+	}
+
+	// 连接在通知断开后才归还名额
+	for i := 0; i < 100 && server.Stats().ActiveConnections != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	again, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Disconnect()
+	waitEvent(t, serverEvents, EventConnected)
+
+	stats := server.Stats()
+	if stats.Rejected["ip_limit"] != 1 || stats.Rejected["filter"] != 1 {
+		t.Fatal("unexpected rejected:", stats.Rejected)
+	}
+	if stats.Accepted != 2 {
+		t.Fatal("expect 2 accepted, got", stats.Accepted)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(&RateLimit{PacketsPerSecond: 10, PacketBurst: 2, BytesPerSecond: 1000})
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if d := l.take(10, now, false); d != 0 {
+			t.Fatal("unexpected wait:", d)
+		}
+	}
+	if d := l.take(10, now, false); d != 100*time.Millisecond {
+		t.Fatal("unexpected wait:", d)
+	}
+
+	// 大于ByteBurst的数据包在令牌桶已满时允许收到
+	now = now.Add(time.Second)
+	if d := l.take(5000, now, false); d != 0 {
+		t.Fatal("unexpected wait:", d)
+	}
+	if d := l.take(10, now, true); d != 4010*time.Millisecond {
+		t.Fatal("unexpected wait:", d)
+	}
+}
+
+func TestConnection_ReceiveLimits(t *testing.T) {
+	server := CreateTCPServerWithConfig(&Config{
+		ReceiveRate:   &RateLimit{PacketsPerSecond: 1, PacketBurst: 2, Action: RateLimitDisconnect},
+		MaxPacketSize: 8,
+	})
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	conn := waitEvent(t, serverEvents, EventConnected).Conn
+
+	client.Send(make([]byte, 9))
+	if event := waitEvent(t, serverEvents, EventDisconnected); event.Err != ErrPacketTooLarge {
+		t.Fatal("expect ErrPacketTooLarge, got", event.Err)
+	}
+	if data, ok := <-conn.ReceiveDataChan(); ok {
+		t.Fatal("unexpected data:", data)
+	}
+
+	client, _, err = CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	conn = waitEvent(t, serverEvents, EventConnected).Conn
+
+	for i := 0; i < 3; i++ {
+		client.Send([]byte{byte(i)})
+	}
+	for i := 0; i < 2; i++ {
+		if data := <-conn.ReceiveDataChan(); len(data) != 1 || data[0] != byte(i) {
+			t.Fatal("unexpected data:", data)
+		}
+	}
+	if event := waitEvent(t, serverEvents, EventDisconnected); event.Err != ErrRateLimited {
+		t.Fatal("expect ErrRateLimited, got", event.Err)
+	}
+}
+
+// 包头中的长度超过MaxPacketSize时不等待数据包的内容
+func TestConnection_MaxPacketSizeHeader(t *testing.T) {
+	for _, loops := range []int{0, 1} {
+		server := CreateTCPServerWithConfig(&Config{MaxPacketSize: 8, EventLoops: loops})
+		serverEvents, err := server.Start("127.0.0.1:0", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Stop()
+
+		conn, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		waitEvent(t, serverEvents, EventConnected)
+
+		header, _ := DefaultLengthFieldSpec.appendHeader(nil, 1000)
+		conn.Write(header)
+		if event := waitEvent(t, serverEvents, EventDisconnected); event.Err != ErrPacketTooLarge {
+			t.Fatalf("EventLoops %d: expect ErrPacketTooLarge, got %v", loops, event.Err)
+		}
+	}
+}
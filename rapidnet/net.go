@@ -1,30 +1,115 @@
 package rapidnet
 
 import (
-	"bufio"
+	"errors"
 	"net"
+	"time"
 )
 
-// // ICallback interface
-// type ICallback interface {
-// 	Disconnected(conn *Connection, err error)
-// 	Connected(conn *Connection)
-// 	Received(conn *Connection, data []byte)
-// }
+// Handler 以回调的方式处理连接事件, 可替代事件chan.
+// OnSendFailed在连接的发送goroutine中调用, 其它回调在连接的接收goroutine中调用,
+// 不同连接的回调会并发执行. 使用Handler时不需要读取Connection.ReceiveDataChan().
+// OnPacket返回后不再使用data时, 包处理器实现了PooledPacketHandler的可以调用Packet(data).Release()归还缓冲区.
+type Handler interface {
+	OnConnected(conn *Connection)
+	OnPacket(conn *Connection, data []byte)
+	OnDisconnected(conn *Connection, err error)
+	OnSendFailed(conn *Connection, err error)
+}
 
-// Config 用于初始化网络引擎
+// Config 用于初始化网络引擎.
+// 可通过Init设置全局配置, 也可以通过CreateTCPServerWithConfig/CreateTCPClientWithConfig
+// 为每个服务器或客户端单独指定, 未设置(零值)的字段使用全局配置.
+// 需要关闭全局配置启用的功能时, HeartbeatInterval、FlushDelay、EventLoops及MaxPacketSize设为负数,
+// SendPolicy设为SendPolicyDrop; 其它字段不能用零值覆盖全局配置
 type Config struct {
 	PacketHandlerFactory func(net.Conn) PacketHandler
+
+	// HandshakeTimeout TLS握手的超时时间, 为0时使用defaultHandshakeTimeout
+	HandshakeTimeout time.Duration
+
+	// HeartbeatInterval 超过此时间没有收到数据时发送心跳包, 小于0或未设置时不启用心跳.
+	// 心跳包是长度为0的数据包, 启用心跳后不会传递给上层, 通信双方都需要启用
+	HeartbeatInterval time.Duration
+
+	// HeartbeatMaxMissed 连续发送心跳包仍未收到数据的次数超过此值时,
+	// 以ErrIdleTimeout断开连接. 为0时使用defaultHeartbeatMaxMissed
+	HeartbeatMaxMissed int
+
+	// SendQueueSize 每个连接发送队列的长度, 为0时使用defaultSendQueueSize
+	SendQueueSize int
+
+	// SendPolicy 发送队列已满时Connection.Send的处理方式, 未设置时为SendPolicyDrop
+	SendPolicy SendPolicy
+
+	// FlushDelay 发送数据后最多等待此时间再调用PacketHandler.Flush, 期间发送的数据合并写入,
+	// 以增加延迟为代价减少系统调用. 小于0或未设置时每批数据(发送队列中已有的数据)写入后立即flush
+	FlushDelay time.Duration
+
+	// EventLoops 大于0时服务器使用EventLoops模式: 在Linux上由固定数量的事件循环通过epoll读取所有连接,
+	// 连接空闲时不占用goroutine, 适用于大量空闲连接. 只用于包处理器实现了FrameDecoder的TCP连接
+	// (不包括TLS), 其它连接及其它平台仍使用每个连接两个goroutine的模式.
+	// 此模式下OnConnected在accept的goroutine中调用, OnPacket及OnDisconnected在事件循环中调用,
+	// 回调不应阻塞; 使用事件chan时, 连接的ReceiveDataChan已满时暂停读取该连接,
+	// 事件chan已满时EventDisconnected在新的goroutine中等待发送, 不阻塞事件循环. 小于0时不使用
+	EventLoops int
+
+	// RejectWhenFull 连接数达到上限时服务器继续accept, 向新连接发送ServerFullPacket
+	// 生成的数据包后关闭, 并以ErrServerFull通知EventRejected. 同时发送拒绝数据包的连接最多64个,
+	// 超过时不发送直接关闭.
+	// 为false时达到上限后暂停accept, 新连接在内核的队列中等待
+	RejectWhenFull bool
+
+	// ServerFullPacket 生成因连接数达到上限拒绝连接时发送给客户端的数据包, 为nil或返回nil时不发送.
+	// 连接实现了AmplificationLimiter(例如UDP)时, 编码后超过已收到的字节数的数据包不发送
+	ServerFullPacket func(addr net.Addr) []byte
+
+	// AcceptFilter 在连接登记到服务器之前调用, 返回false时以ErrAcceptFiltered拒绝连接,
+	// 可用于实现黑白名单. 在accept的goroutine中调用, 不应阻塞
+	AcceptFilter func(addr net.Addr) bool
+
+	// ReceiveRate 每个连接收到数据包的速率限制, 为nil时不限制
+	ReceiveRate *RateLimit
+
+	// MaxPacketSize 收到的数据包的最大长度, 超过时以ErrPacketTooLarge断开连接.
+	// 与封包格式的最大长度(例如LengthFieldSpec.MaxFrameSize)分别设置, 小于0或未设置时不限制.
+	// 包处理器实现了PacketSizeLimiter(例如LengthFieldPacketHandler)时在解码包头时检查, 不会分配超过限制的数据包,
+	// 否则在收到完整的数据包后检查
+	MaxPacketSize int
+
+	// AcceptLimits 每个IP及网段的连接数和新建连接速率的限制, 超过时拒绝连接, 为nil时不限制
+	AcceptLimits *AcceptLimits
+
+	// ProxyProtocol 不为nil时, 服务器接受的连接需要先发送PROXY protocol头, 在连接的goroutine中读取(在TLS握手之前),
+	// 之后按头中的客户端地址检查AcceptFilter及AcceptLimits. 来源不可信或头格式错误时拒绝连接
+	ProxyProtocol *ProxyProtocol
 }
 
+// SendPolicy 发送队列已满时的处理方式
+type SendPolicy int
+
+const (
+	// SendPolicyDefault 使用全局配置, 全局配置也未设置时为SendPolicyDrop
+	SendPolicyDefault SendPolicy = iota
+
+	// SendPolicyDrop 丢弃数据, Send返回ErrSendQueueFull
+	SendPolicyDrop
+
+	// SendPolicyBlock 等待队列有空位, 直到连接断开
+	SendPolicyBlock
+
+	// SendPolicyDisconnect 丢弃数据并以ErrSlowConsumer断开连接, Send返回ErrSendQueueFull
+	SendPolicyDisconnect
+)
+
+const (
+	defaultHandshakeTimeout   = time.Second * 10
+	defaultHeartbeatMaxMissed = 3
+	defaultSendQueueSize      = 16
+)
+
 var config = &Config{
-	PacketHandlerFactory: func(c net.Conn) PacketHandler {
-		return &defaultPacketHandler{
-			conn:      c,
-			bufReader: bufio.NewReader(c),
-			bufWriter: bufio.NewWriter(c),
-		}
-	},
+	PacketHandlerFactory: NewLengthFieldPacketHandlerFactory(DefaultLengthFieldSpec),
 }
 
 // Init 初始化
@@ -32,6 +117,156 @@ func Init(cfg *Config) {
 	config = cfg
 }
 
+func (cfg *Config) handshakeTimeout() time.Duration {
+	if cfg != nil && cfg.HandshakeTimeout > 0 {
+		return cfg.HandshakeTimeout
+	}
+	if config.HandshakeTimeout > 0 {
+		return config.HandshakeTimeout
+	}
+	return defaultHandshakeTimeout
+}
+
+// heartbeat 返回心跳间隔及允许丢失的次数, 间隔为0表示不启用心跳
+func (cfg *Config) heartbeat() (time.Duration, int) {
+	if cfg == nil || cfg.HeartbeatInterval == 0 {
+		cfg = config
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		return 0, 0
+	}
+	if cfg.HeartbeatMaxMissed <= 0 {
+		return cfg.HeartbeatInterval, defaultHeartbeatMaxMissed
+	}
+	return cfg.HeartbeatInterval, cfg.HeartbeatMaxMissed
+}
+
+func (cfg *Config) sendQueueSize() int {
+	if cfg != nil && cfg.SendQueueSize > 0 {
+		return cfg.SendQueueSize
+	}
+	if config.SendQueueSize > 0 {
+		return config.SendQueueSize
+	}
+	return defaultSendQueueSize
+}
+
+func (cfg *Config) sendPolicy() SendPolicy {
+	if cfg != nil && cfg.SendPolicy != SendPolicyDefault {
+		return cfg.SendPolicy
+	}
+	if config.SendPolicy != SendPolicyDefault {
+		return config.SendPolicy
+	}
+	return SendPolicyDrop
+}
+
+func (cfg *Config) eventLoops() int {
+	if cfg != nil && cfg.EventLoops != 0 {
+		return cfg.EventLoops
+	}
+	return config.EventLoops
+}
+
+func (cfg *Config) flushDelay() time.Duration {
+	if cfg != nil && cfg.FlushDelay != 0 {
+		return cfg.FlushDelay
+	}
+	return config.FlushDelay
+}
+
+// rejectWhenFull 返回连接数达到上限时是否拒绝新连接, 以及生成拒绝数据包的函数
+func (cfg *Config) rejectWhenFull() (bool, func(net.Addr) []byte) {
+	if cfg == nil || !cfg.RejectWhenFull {
+		cfg = config
+	}
+	return cfg.RejectWhenFull, cfg.ServerFullPacket
+}
+
+func (cfg *Config) receiveRate() *RateLimit {
+	if cfg != nil && cfg.ReceiveRate != nil {
+		return cfg.ReceiveRate
+	}
+	return config.ReceiveRate
+}
+
+func (cfg *Config) maxPacketSize() int {
+	if cfg != nil && cfg.MaxPacketSize != 0 {
+		return cfg.MaxPacketSize
+	}
+	return config.MaxPacketSize
+}
+
+func (cfg *Config) acceptFilter() func(net.Addr) bool {
+	if cfg != nil && cfg.AcceptFilter != nil {
+		return cfg.AcceptFilter
+	}
+	return config.AcceptFilter
+}
+
+func (cfg *Config) acceptLimits() *AcceptLimits {
+	if cfg != nil && cfg.AcceptLimits != nil {
+		return cfg.AcceptLimits
+	}
+	return config.AcceptLimits
+}
+
+func (cfg *Config) proxyProtocol() *ProxyProtocol {
+	if cfg != nil && cfg.ProxyProtocol != nil {
+		return cfg.ProxyProtocol
+	}
+	return config.ProxyProtocol
+}
+
+// newPacketHandler 使用cfg中的PacketHandlerFactory创建包处理器, 未设置时使用全局配置
+func (cfg *Config) newPacketHandler(conn net.Conn) PacketHandler {
+	if cfg != nil && cfg.PacketHandlerFactory != nil {
+		return cfg.PacketHandlerFactory(conn)
+	}
+	return config.PacketHandlerFactory(conn)
+}
+
+// ErrServerClosed 服务器关闭时, 连接断开事件携带此错误
+var ErrServerClosed = errors.New("rapidnet: server closed")
+
+// ErrIdleTimeout 心跳超时, 对端长时间没有响应
+var ErrIdleTimeout = errors.New("rapidnet: idle timeout")
+
+var (
+	// ErrSendQueueFull 发送队列已满
+	ErrSendQueueFull = errors.New("rapidnet: send queue is full")
+
+	// ErrConnClosed 连接已断开
+	ErrConnClosed = errors.New("rapidnet: connection closed")
+
+	// ErrSlowConsumer 使用SendPolicyDisconnect时, 发送队列已满导致断开
+	ErrSlowConsumer = errors.New("rapidnet: slow consumer")
+
+	// ErrServerFull 连接数已达到上限, 新连接被拒绝
+	ErrServerFull = errors.New("rapidnet: server full")
+
+	// ErrRateLimited 使用RateLimitDisconnect时, 收到数据的速率超过限制导致断开
+	ErrRateLimited = errors.New("rapidnet: rate limited")
+
+	// ErrPacketTooLarge 收到的数据包超过Config.MaxPacketSize导致断开
+	ErrPacketTooLarge = errors.New("rapidnet: packet too large")
+
+	// ErrAcceptFiltered 连接被Config.AcceptFilter拒绝
+	ErrAcceptFiltered = errors.New("rapidnet: connection rejected by filter")
+
+	// ErrTooManyConnsPerIP 同一IP的连接数超过AcceptLimits.MaxConnsPerIP
+	ErrTooManyConnsPerIP = errors.New("rapidnet: too many connections from ip")
+
+	// ErrTooManyConnsPerCIDR 同一网段的连接数超过AcceptLimits.CIDRLimits
+	ErrTooManyConnsPerCIDR = errors.New("rapidnet: too many connections from network")
+
+	// ErrConnectRateExceeded 同一IP新建连接的速率超过AcceptLimits.ConnectRate
+	ErrConnectRateExceeded = errors.New("rapidnet: connect rate exceeded")
+)
+
+// 调用Connection.Disconnect主动断开
+var errStopped = errors.New("stopped")
+
 // EventType 通知上层事件类型
 type EventType int
 
@@ -44,6 +279,13 @@ const (
 
 	// EventSendFailed 发送错误
 	EventSendFailed
+
+	// EventReconnecting 正在重连, Err为上次断开或连接失败的原因
+	EventReconnecting
+
+	// EventRejected 服务器拒绝了新连接, Conn为nil, Addr为对端地址, Err为拒绝的原因.
+	// 事件chan已满时丢弃, 可以通过TCPServer.Stats统计
+	EventRejected
 )
 
 // Event 事件
@@ -51,4 +293,10 @@ type Event struct {
 	Type EventType
 	Err  error
 	Conn *Connection
+	Addr net.Addr // EventRejected时为被拒绝连接的对端地址
+}
+
+// RejectHandler 可由Handler实现, 用于接收EventRejected. 在accept或发送拒绝数据包的goroutine中调用, 不应阻塞
+type RejectHandler interface {
+	OnRejected(addr net.Addr, err error)
 }
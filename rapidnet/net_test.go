@@ -1 +1,603 @@
 package rapidnet
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTCPServer_Shutdown(t *testing.T) {
+	server := CreateTCPServer()
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := CreateTCPClient()
+	_, clientEvents, err := client.Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := <-serverEvents
+	if event.Type != EventConnected {
+		t.Fatal("expect EventConnected, got", event.Type)
+	}
+	for i := 0; i < 8; i++ {
+		event.Conn.Send([]byte{byte(i)})
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- server.Shutdown(ctx)
+	}()
+
+	event = <-serverEvents
+	if event.Type != EventDisconnected || event.Err != ErrServerClosed {
+		t.Fatal("unexpected event:", event.Type, event.Err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Shutdown:", err)
+	}
+
+	for i := 0; i < 8; i++ {
+		data := <-client.conn.ReceiveDataChan()
+		if len(data) != 1 || data[0] != byte(i) {
+			t.Fatal("unexpected data:", data)
+		}
+	}
+	for event := range clientEvents {
+		if event.Type == EventDisconnected {
+			break
+		}
+	}
+}
+
+type testHandler struct {
+	connected    chan *Connection
+	packets      chan []byte
+	disconnected chan error
+}
+
+func (h *testHandler) OnConnected(conn *Connection)               { h.connected <- conn }
+func (h *testHandler) OnPacket(conn *Connection, data []byte)     { h.packets <- data }
+func (h *testHandler) OnDisconnected(conn *Connection, err error) { h.disconnected <- err }
+func (h *testHandler) OnSendFailed(conn *Connection, err error)   {}
+
+func TestTCPServer_StartWithHandler(t *testing.T) {
+	h := &testHandler{
+		connected:    make(chan *Connection, 1),
+		packets:      make(chan []byte, 1),
+		disconnected: make(chan error, 1),
+	}
+	server := CreateTCPServer()
+	if err := server.StartWithHandler("127.0.0.1:0", 10, h); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client := CreateTCPClient()
+	conn, _, err := client.Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-h.connected
+
+	conn.Send([]byte("hello"))
+	if data := <-h.packets; string(data) != "hello" {
+		t.Fatal("unexpected data:", data)
+	}
+
+	client.Disconnect()
+	if err := <-h.disconnected; err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestTCPServer_Serve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rapidnet.sock")
+	unixListener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeListener := NewPipeListener()
+
+	tests := []struct {
+		name     string
+		listener net.Listener
+		dial     func() (net.Conn, error)
+	}{
+		{"unix", unixListener, func() (net.Conn, error) { return net.Dial("unix", path) }},
+		{"pipe", pipeListener, pipeListener.Dial},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := CreateTCPServer()
+			serverEvents, err := server.Serve(tt.listener, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Stop()
+
+			client := CreateTCPClient()
+			conn, _, err := client.ConnectWith(tt.dial)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Disconnect()
+
+			event := <-serverEvents
+			if event.Type != EventConnected {
+				t.Fatal("expect EventConnected, got", event.Type)
+			}
+			conn.Send([]byte("hello"))
+			data := <-event.Conn.ReceiveDataChan()
+			if string(data) != "hello" {
+				t.Fatal("unexpected data:", data)
+			}
+			event.Conn.Send(data)
+			if data := <-conn.ReceiveDataChan(); string(data) != "hello" {
+				t.Fatal("unexpected data:", data)
+			}
+		})
+	}
+}
+
+func testTLSConfig(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	clientConfig := &tls.Config{RootCAs: pool}
+	return serverConfig, clientConfig
+}
+
+func TestTCPServer_StartTLS(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfig(t)
+
+	server := CreateTCPServerWithConfig(&Config{HandshakeTimeout: time.Millisecond * 200})
+	serverEvents, err := server.StartTLS("127.0.0.1:0", 1, serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// 不进行握手的连接在超时后被关闭, 不会一直占用名额
+	raw, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := raw.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expect the connection to be closed")
+	}
+
+	client := CreateTCPClient()
+	conn, _, err := client.ConnectTLS(server.Addr().String(), 1000, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	event := <-serverEvents
+	if event.Type != EventConnected {
+		t.Fatal("expect EventConnected, got", event.Type)
+	}
+	if _, ok := event.Conn.conn.(*tls.Conn); !ok {
+		t.Fatal("expect *tls.Conn")
+	}
+
+	conn.Send([]byte("hello"))
+	if data := <-event.Conn.ReceiveDataChan(); string(data) != "hello" {
+		t.Fatal("unexpected data:", data)
+	}
+}
+
+func waitEvent(t *testing.T, events <-chan *Event, eventType EventType) *Event {
+	for {
+		select {
+		case event := <-events:
+			if event.Type == eventType {
+				return event
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for event", eventType)
+		}
+	}
+}
+
+func TestConnection_Heartbeat(t *testing.T) {
+	cfg := &Config{HeartbeatInterval: time.Millisecond * 50, HeartbeatMaxMissed: 2}
+	server := CreateTCPServerWithConfig(cfg)
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// 双方都启用心跳时, 空闲的连接不会断开
+	client := CreateTCPClientWithConfig(cfg)
+	if _, _, err := client.Connect(server.Addr().String(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	<-serverEvents
+	select {
+	case event := <-serverEvents:
+		t.Fatal("unexpected event:", event.Type, event.Err)
+	case <-time.After(time.Millisecond * 500):
+	}
+	client.Disconnect()
+	<-serverEvents
+
+	// 对端不回复心跳时, 以ErrIdleTimeout断开
+	silent := CreateTCPClient()
+	conn, _, err := silent.Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Disconnect()
+	go func() {
+		for range conn.ReceiveDataChan() {
+		}
+	}()
+
+	<-serverEvents
+	select {
+	case event := <-serverEvents:
+		if event.Type != EventDisconnected || event.Err != ErrIdleTimeout {
+			t.Fatal("unexpected event:", event.Type, event.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for ErrIdleTimeout")
+	}
+}
+
+func TestConfig_Override(t *testing.T) {
+	// 全局配置启用心跳及SendPolicyBlock
+	old := config
+	global := *config
+	global.HeartbeatInterval = time.Millisecond * 50
+	global.HeartbeatMaxMissed = 2
+	global.SendPolicy = SendPolicyBlock
+	Init(&global)
+	defer Init(old)
+
+	// 第二个服务器关闭心跳并使用SendPolicyDrop
+	servers := []*TCPServer{
+		CreateTCPServer(),
+		CreateTCPServerWithConfig(&Config{HeartbeatInterval: -1, SendPolicy: SendPolicyDrop}),
+	}
+	var events []<-chan *Event
+	var conns []*Connection
+	for _, server := range servers {
+		serverEvents, err := server.Start("127.0.0.1:0", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Stop()
+		events = append(events, serverEvents)
+
+		// 客户端不回复心跳
+		client, _, err := CreateTCPClientWithConfig(&Config{HeartbeatInterval: -1}).Connect(server.Addr().String(), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Disconnect()
+		go func() {
+			for range client.ReceiveDataChan() {
+			}
+		}()
+		conns = append(conns, waitEvent(t, serverEvents, EventConnected).Conn)
+	}
+
+	if conns[0].sendPolicy != SendPolicyBlock || conns[1].sendPolicy != SendPolicyDrop {
+		t.Fatal("unexpected send policy:", conns[0].sendPolicy, conns[1].sendPolicy)
+	}
+	if event := waitEvent(t, events[0], EventDisconnected); event.Err != ErrIdleTimeout {
+		t.Fatal("expect ErrIdleTimeout, got", event.Err)
+	}
+	select {
+	case event := <-events[1]:
+		t.Fatal("unexpected event:", event.Type, event.Err)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestConnection_SendQueue(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	cfg := &Config{SendQueueSize: 2, SendPolicy: SendPolicyDisconnect}
+	conn := &Connection{conn: c1, eventChan: make(chan *Event, 4), release: func() {}}
+	conn.init(cfg)
+	conn.packetHandler = cfg.newPacketHandler(c1)
+	go conn.loop()
+
+	// 对端不读取数据, 第一个数据包阻塞在发送中, 之后填满队列
+	for i := 0; i < 2; i++ {
+		for conn.TrySend([]byte{1}) == nil {
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	if err := conn.TrySend([]byte{1}); err != ErrSendQueueFull {
+		t.Fatal("expect ErrSendQueueFull, got", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := conn.SendContext(ctx, []byte{1}); err != context.DeadlineExceeded {
+		t.Fatal("expect DeadlineExceeded, got", err)
+	}
+
+	if err := conn.Send([]byte{1}); err != ErrSendQueueFull {
+		t.Fatal("expect ErrSendQueueFull, got", err)
+	}
+	for event := range conn.eventChan {
+		if event.Type == EventDisconnected {
+			if event.Err != ErrSlowConsumer {
+				t.Fatal("expect ErrSlowConsumer, got", event.Err)
+			}
+			break
+		}
+	}
+
+	if err := conn.TrySend([]byte{1}); err != ErrConnClosed {
+		t.Fatal("expect ErrConnClosed, got", err)
+	}
+}
+
+func TestConnection_FlushDelay(t *testing.T) {
+	server := CreateTCPServerWithConfig(&Config{FlushDelay: time.Millisecond * 20})
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	conn := waitEvent(t, serverEvents, EventConnected).Conn
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		conn.Send([]byte{byte(i)})
+	}
+	for i := 0; i < 3; i++ {
+		if data := <-client.ReceiveDataChan(); len(data) != 1 || data[0] != byte(i) {
+			t.Fatal("unexpected data:", data)
+		}
+	}
+	if d := time.Since(start); d < time.Millisecond*20 {
+		t.Fatal("flushed before FlushDelay:", d)
+	}
+}
+
+func TestTCPServer_Broadcast(t *testing.T) {
+	server := CreateTCPServer()
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	var clients []*Connection
+	var except *Connection
+	for i := 0; i < 3; i++ {
+		conn, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Disconnect()
+		clients = append(clients, conn)
+		except = waitEvent(t, serverEvents, EventConnected).Conn
+	}
+
+	count := 0
+	server.ForEach(func(conn *Connection) bool {
+		count++
+		return true
+	})
+	if count != 3 {
+		t.Fatal("expect 3 connections, got", count)
+	}
+
+	if dropped := server.BroadcastExcept([]byte("world"), except); dropped != 0 {
+		t.Fatal("unexpected dropped:", dropped)
+	}
+	for _, conn := range clients[:2] {
+		if data := <-conn.ReceiveDataChan(); string(data) != "world" {
+			t.Fatal("unexpected data:", data)
+		}
+	}
+	select {
+	case data := <-clients[2].ReceiveDataChan():
+		t.Fatal("unexpected data:", data)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+// 新连接登记到服务器时, 并发的Broadcast可以读取其包处理器
+func TestTCPServer_BroadcastWhileAccepting(t *testing.T) {
+	server := CreateTCPServer()
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				server.Broadcast([]byte("hello"))
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		conn, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Disconnect()
+		waitEvent(t, serverEvents, EventConnected)
+	}
+}
+
+func TestTCPServer_RejectWhenFull(t *testing.T) {
+	server := CreateTCPServerWithConfig(&Config{
+		RejectWhenFull:   true,
+		ServerFullPacket: func(addr net.Addr) []byte { return []byte("full") },
+	})
+	serverEvents, err := server.Start("127.0.0.1:0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	conn, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+	waitEvent(t, serverEvents, EventConnected)
+
+	rejected, clientEvents, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := <-rejected.ReceiveDataChan(); string(data) != "full" {
+		t.Fatal("unexpected data:", data)
+	}
+	waitEvent(t, clientEvents, EventDisconnected)
+
+	event := waitEvent(t, serverEvents, EventRejected)
+	if event.Err != ErrServerFull || event.Addr.String() != rejected.conn.LocalAddr().String() {
+		t.Fatal("unexpected event:", event.Err, event.Addr)
+	}
+	if n := server.Stats().Rejected["full"]; n != 1 {
+		t.Fatal("expect 1 rejected, got", n)
+	}
+}
+
+type userIDKey struct{}
+
+// 同时发送拒绝数据包的连接达到上限时直接关闭新连接
+func TestTCPServer_RejectWhenFullConcurrency(t *testing.T) {
+	var sending int32
+	unblock := make(chan struct{})
+	server := CreateTCPServerWithConfig(&Config{
+		RejectWhenFull: true,
+		ServerFullPacket: func(addr net.Addr) []byte {
+			atomic.AddInt32(&sending, 1)
+			<-unblock
+			return []byte("full")
+		},
+	})
+	serverEvents, err := server.Start("127.0.0.1:0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	conn, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Disconnect()
+	waitEvent(t, serverEvents, EventConnected)
+
+	for i := 0; i <= maxConcurrentRejects; i++ {
+		if i == maxConcurrentRejects {
+			for j := 0; j < 1000 && atomic.LoadInt32(&sending) < maxConcurrentRejects; j++ {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		c, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	waitEvent(t, serverEvents, EventRejected)
+	if n := atomic.LoadInt32(&sending); n != maxConcurrentRejects {
+		t.Fatal("expect", maxConcurrentRejects, "rejects sending packet, got", n)
+	}
+
+	close(unblock)
+	for i := 0; i < maxConcurrentRejects; i++ {
+		waitEvent(t, serverEvents, EventRejected)
+	}
+}
+
+func TestConnection_Value(t *testing.T) {
+	h := &testHandler{
+		connected:    make(chan *Connection, 1),
+		packets:      make(chan []byte, 1),
+		disconnected: make(chan error, 1),
+	}
+	server := CreateTCPServer()
+	if err := server.StartWithHandler("127.0.0.1:0", 10, h); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client := CreateTCPClient()
+	clientConn, _, err := client.Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-h.connected
+	if conn.ID() == 0 || conn.ID() == clientConn.ID() {
+		t.Fatal("unexpected id:", conn.ID(), clientConn.ID())
+	}
+
+	conn.SetValue(userIDKey{}, 1001)
+	client.Disconnect()
+	<-h.disconnected
+	if v, ok := conn.Value(userIDKey{}).(int); !ok || v != 1001 {
+		t.Fatal("unexpected value:", conn.Value(userIDKey{}))
+	}
+	conn.DeleteValue(userIDKey{})
+	if conn.Value(userIDKey{}) != nil {
+		t.Fatal("value should be deleted")
+	}
+}
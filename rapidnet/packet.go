@@ -1,112 +1,106 @@
 package rapidnet
 
-import (
-	"bufio"
-	"errors"
-	"io"
-	"net"
-	"time"
-)
-
+// PacketHandler 负责从连接中读取数据包及将数据包写入连接.
+// Receive在没有完整的数据包时可以返回nil, nil, 连接会再次调用.
+// Send可以先缓存数据, 连接在每批数据发送后调用Flush将缓存的数据写入连接,
+// Flush返回前不能修改已发送的数据.
 type PacketHandler interface {
 	Receive() ([]byte, error)
 	Send([]byte) error
+	Flush() error
 }
 
-const (
-	defaultTag        = 0xDCFE
-	defaultTagSize    = 2 // 2bytes
-	defaultLenSize    = 2 //2 bytes
-	defaultHeaderSize = defaultTagSize + defaultLenSize
-)
+// FrameEncoder 可选接口. 包处理器同时实现了FrameFormatter时, 广播时数据对每种格式只编码一次,
+// 编码后的帧由该格式的所有连接共享; 否则每个连接单独编码.
+// 编码结果不能依赖于具体的连接(例如每个连接不同的加密密钥)
+type FrameEncoder interface {
+	// EncodeFrame 将数据编码为完整的帧
+	EncodeFrame(data []byte) ([]byte, error)
 
-type defaultPacketHandler struct {
-	conn      net.Conn
-	bufReader *bufio.Reader
-	bufWriter *bufio.Writer
+	// SendFrame 发送EncodeFrame编码的帧, 不能修改frame. 与Send一样可以缓存到Flush时写入
+	SendFrame(frame []byte) error
+}
 
-	data        []byte
-	dataLen     int
-	readed      int
-	headerReady bool
+// FrameFormatter 可选接口, 与FrameEncoder一起实现. FrameFormat返回编码格式的标识(可以用==比较),
+// 标识相同的包处理器对同一数据编码的结果必须相同
+type FrameFormatter interface {
+	FrameFormat() interface{}
 }
 
-func (obj *defaultPacketHandler) Receive() ([]byte, error) {
-	if !obj.headerReady {
-		// 读取header
-		obj.conn.SetReadDeadline(time.Now().Add(time.Second * 2))
-		p, err := obj.bufReader.Peek(defaultHeaderSize)
-		//fmt.Println(err)
-		if err == io.EOF {
-			return nil, err
-		}
-		if err == nil && len(p) == defaultHeaderSize {
-			if p[0] != 0xFE || p[1] != 0xDC {
-				return nil, errors.New("invalid data")
-			}
+// FrameDecoder 可选接口. 包处理器实现后可以用于Config.EventLoops模式,
+// 由事件循环读取数据后调用DecodeFrame解码, 不再调用Receive
+type FrameDecoder interface {
+	// DecodeFrame 从buf中解码一个数据包, 返回数据包及消耗的字节数.
+	// 数据不完整时返回nil, 0, nil. 返回的数据包不能引用buf
+	DecodeFrame(buf []byte) ([]byte, int, error)
+}
 
-			obj.bufReader.Discard(defaultHeaderSize)
-			obj.headerReady = true
+// PooledPacketHandler 可选接口. PooledPackets返回true表示Receive/DecodeFrame返回的数据包由NewPacket分配,
+// 连接丢弃的数据包(心跳包、超过限制等)会归还到缓冲池. 未实现时连接不归还包处理器返回的数据包,
+// 包处理器可以重复使用自己的缓冲区
+type PooledPacketHandler interface {
+	PooledPackets() bool
+}
 
-			//fmt.Println(p)
-			obj.dataLen = int(p[2]) + (int(p[3]) << 8)
-			obj.data = make([]byte, obj.dataLen)
-		} else {
-			nerr, ok := err.(net.Error)
-			//fmt.Println(nerr, ok)
-			if ok {
-				if nerr.Timeout() {
-					return nil, nil
-				} else if nerr.Temporary() {
-					return nil, nerr
-				} else {
-					return nil, err
-				}
-			} else {
-				return nil, err
-			}
-		}
-	}
+// PacketSizeLimiter 可选接口. 包处理器实现后, 设置了Config.MaxPacketSize时由包处理器在解码包头时检查长度,
+// 超过时Receive/DecodeFrame返回ErrPacketTooLarge, 不再分配及读取数据包
+type PacketSizeLimiter interface {
+	SetMaxPacketSize(n int)
+}
 
-	// read body
+// Unreader 可由PacketHandler实现, 用于将连接交给其它进程(参见TCPServer.Handoff及TCPServer.ServeHandoff)
+type Unreader interface {
+	// Unread 返回已从连接读取但还没有作为数据包返回的数据, 调用后不能再使用包处理器接收数据
+	Unread() []byte
 
-	obj.conn.SetReadDeadline(time.Now().Add(time.Second * 2))
-	n, err := obj.bufReader.Read(obj.data[obj.readed:])
-	if err == nil {
-		obj.readed += n
-		if obj.readed == obj.dataLen {
-			p := obj.data
-			obj.data = nil
-			obj.readed = 0
-			obj.headerReady = false
-			obj.dataLen = 0
-			return p, nil
-		}
-	} else if err == io.EOF {
-		return nil, err
-	}
+	// Restore 在接收数据之前调用, data为旧进程中Unread返回的数据, 之后先从data中接收数据包
+	Restore(data []byte)
+}
+
+// broadcast 向多个连接发送同一个数据包
+type broadcast struct {
+	data    []byte
+	frames  []encodedFrame // 每种格式编码后的帧
+	dropped int            // 丢弃的数量
+}
 
-	return nil, nil
+// encodedFrame 按一种格式编码后的帧
+type encodedFrame struct {
+	format interface{}
+	frame  []byte
+	err    error // 编码的错误
 }
 
-func (obj *defaultPacketHandler) Send(data []byte) error {
-	len := len(data)
+func (b *broadcast) send(conn *Connection) {
+	p := outgoing{data: b.data}
+	if encoder, ok := conn.packetHandler.(FrameEncoder); ok {
+		frame, err := b.encode(encoder)
+		if err != nil {
+			b.dropped++
+			return
+		}
+		p = outgoing{data: frame, frame: true, size: len(b.data)}
+	}
 
-	if len > 0xFFFF {
-		return errors.New("too large")
+	if conn.offer(p) != nil {
+		b.dropped++
 	}
+}
 
-	n, err := obj.bufWriter.Write([]byte{0xFE, 0xDC, byte(len & 0xFF), byte((len & 0xFF00) >> 8)})
-	if n != 4 || err != nil {
-		obj.conn.Close()
-		return err
+// encode 返回encoder的格式编码后的帧, 同一格式只编码一次
+func (b *broadcast) encode(encoder FrameEncoder) ([]byte, error) {
+	formatter, ok := encoder.(FrameFormatter)
+	if !ok {
+		return encoder.EncodeFrame(b.data)
 	}
 
-	n, err = obj.bufWriter.Write(data)
-	if n != len || err != nil {
-		obj.conn.Close()
-		return err
+	format := formatter.FrameFormat()
+	for _, f := range b.frames {
+		if f.format == format {
+			return f.frame, f.err
+		}
 	}
-	obj.bufWriter.Flush()
-	return nil
+	frame, err := encoder.EncodeFrame(b.data)
+	b.frames = append(b.frames, encodedFrame{format: format, frame: frame, err: err})
+	return frame, err
 }
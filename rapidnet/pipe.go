@@ -0,0 +1,67 @@
+package rapidnet
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var errPipeListenerClosed = errors.New("rapidnet: pipe listener closed")
+
+// PipeListener 使用net.Pipe在内存中建立连接的listener, 不占用端口, 用于测试. 例如
+//
+//	l := NewPipeListener()
+//	server.Serve(l, n)
+//	client.ConnectWith(l.Dial)
+type PipeListener struct {
+	connChan  chan net.Conn
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPipeListener 创建PipeListener
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		connChan:  make(chan net.Conn),
+		closeChan: make(chan struct{}),
+	}
+}
+
+// Dial 建立连接, 等待服务器accept. listener关闭后返回错误
+func (l *PipeListener) Dial() (net.Conn, error) {
+	server, client := net.Pipe()
+	select {
+	case l.connChan <- server:
+		return client, nil
+	case <-l.closeChan:
+		server.Close()
+		client.Close()
+		return nil, errPipeListenerClosed
+	}
+}
+
+// Accept function
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connChan:
+		return c, nil
+	case <-l.closeChan:
+		return nil, errPipeListenerClosed
+	}
+}
+
+// Close 不再接受新连接, 已建立的连接不受影响
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closeChan) })
+	return nil
+}
+
+// Addr function
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
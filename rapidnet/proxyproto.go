@@ -0,0 +1,220 @@
+package rapidnet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrUntrustedProxy 启用PROXY protocol时, 连接的来源不在ProxyProtocol.TrustedNetworks中
+	ErrUntrustedProxy = errors.New("rapidnet: untrusted proxy")
+
+	// ErrInvalidProxyHeader PROXY头格式错误, 或在超时前没有读到完整的PROXY头
+	ErrInvalidProxyHeader = errors.New("rapidnet: invalid proxy protocol header")
+)
+
+// ProxyProtocol 接受连接时读取PROXY protocol(v1及v2)头, 用于负载均衡(例如HAProxy的send-proxy)之后的服务器.
+// 之后连接的RemoteAddr及LocalAddr返回PROXY头中客户端及负载均衡监听的地址, AcceptFilter及AcceptLimits也按客户端地址检查.
+// 头中没有地址时(v1的UNKNOWN, v2的LOCAL命令及非TCP/UDP的地址)使用连接本身的地址
+type ProxyProtocol struct {
+	// TrustedNetworks 允许发送PROXY头的来源(负载均衡)的网段, 其它来源的连接以ErrUntrustedProxy拒绝.
+	// 无法解析出IP的来源(例如Unix socket)总是信任
+	TrustedNetworks []*net.IPNet
+
+	// Timeout 读取PROXY头的超时时间, 为0时使用defaultHandshakeTimeout
+	Timeout time.Duration
+}
+
+const (
+	proxyV1MaxLength  = 107 // 包括"\r\n"
+	proxyV2HeaderSize = 16
+	proxyBufferSize   = 256
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func (p *ProxyProtocol) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	return defaultHandshakeTimeout
+}
+
+// trusted 返回是否接受来自addr的PROXY头
+func (p *ProxyProtocol) trusted(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return true
+	}
+	for _, n := range p.TrustedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept 读取conn的PROXY头, 返回RemoteAddr为客户端地址的连接, PROXY头之后已读取的数据由返回的连接继续读取.
+// 来源不可信时返回ErrUntrustedProxy, 读取失败、超时或格式错误时返回ErrInvalidProxyHeader, 出错时不关闭conn.
+// 返回的连接不是*net.TCPConn, 不能使用EventLoops模式及TCPServer.Handoff
+func (p *ProxyProtocol) Accept(conn net.Conn) (net.Conn, error) {
+	if !p.trusted(conn.RemoteAddr()) {
+		return nil, ErrUntrustedProxy
+	}
+
+	conn.SetReadDeadline(time.Now().Add(p.timeout()))
+	r := bufio.NewReaderSize(conn, proxyBufferSize)
+	remote, local, err := readProxyHeader(r)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	pc := &proxyConn{Conn: conn, remote: remote, local: local}
+	if n := r.Buffered(); n > 0 {
+		pc.unread, _ = r.Peek(n)
+	}
+	return pc, nil
+}
+
+// readProxyHeader 读取v1或v2的PROXY头, 返回客户端及负载均衡的地址, 头中没有地址时返回nil
+func readProxyHeader(r *bufio.Reader) (remote, local net.Addr, err error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if b[0] == proxyV2Signature[0] {
+		return readProxyV2(r)
+	}
+	return readProxyV1(r)
+}
+
+// readProxyV1 读取文本格式的PROXY头, 例如"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readProxyV1(r *bufio.Reader) (remote, local net.Addr, err error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for len(line) < proxyV1MaxLength {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, ErrInvalidProxyHeader
+	}
+	if len(fields) != 6 {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+	if v4 := fields[1] == "TCP4"; v4 != (srcIP.To4() != nil) || v4 != (dstIP.To4() != nil) {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readProxyV2 读取二进制格式的PROXY头: 12字节签名、版本及命令、地址族及协议、2字节地址长度, 之后是地址及TLV
+func readProxyV2(r *bufio.Reader) (remote, local net.Addr, err error) {
+	var header [proxyV2HeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch header[12] & 0xf {
+	case 0: // LOCAL, 负载均衡自己建立的连接(例如健康检查)
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, ErrInvalidProxyHeader
+	}
+
+	var ipLen int
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC, AF_UNIX
+		return nil, nil, nil
+	}
+	if len(body) < ipLen*2+4 {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+	srcIP := net.IP(body[:ipLen])
+	dstIP := net.IP(body[ipLen : ipLen*2])
+	srcPort := int(binary.BigEndian.Uint16(body[ipLen*2:]))
+	dstPort := int(binary.BigEndian.Uint16(body[ipLen*2+2:]))
+
+	switch header[13] & 0xf {
+	case 1: // STREAM
+		return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+	case 2: // DGRAM
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	}
+	return nil, nil, nil
+}
+
+// proxyConn 使用PROXY头中的地址, 先读取读PROXY头时多读取的数据
+type proxyConn struct {
+	net.Conn
+	remote net.Addr // 为nil时使用Conn的地址
+	local  net.Addr
+	unread []byte
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if len(c.unread) > 0 {
+		n := copy(b, c.unread)
+		c.unread = c.unread[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,163 @@
+package rapidnet
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, family byte, addrs ...byte) string {
+		b := append([]byte(nil), proxyV2Signature...)
+		b = append(b, 0x20|cmd, family, 0, byte(len(addrs)))
+		return string(append(b, addrs...))
+	}
+
+	tests := []struct {
+		header string
+		remote string // 为空时头中没有地址
+		local  string
+		err    bool
+	}{
+		{header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", remote: "192.168.0.1:56324", local: "192.168.0.11:443"},
+		{header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:443"},
+		{header: "PROXY UNKNOWN\r\n"},
+		{header: "PROXY UNKNOWN 192.168.0.1 192.168.0.11 56324 443\r\n"},
+		{header: v2(1, 0x11, 192, 168, 0, 1, 192, 168, 0, 11, 0xdc, 0x04, 0x01, 0xbb), remote: "192.168.0.1:56324", local: "192.168.0.11:443"},
+		{header: v2(1, 0x11, 192, 168, 0, 1, 192, 168, 0, 11, 0xdc, 0x04, 0x01, 0xbb, 0x04, 0, 1, 0), remote: "192.168.0.1:56324", local: "192.168.0.11:443"},
+		{header: v2(0, 0x00)},
+		{header: "PROXY TCP4 2001:db8::1 192.168.0.11 56324 443\r\n", err: true},
+		{header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n", err: true},
+		{header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 65536\r\n", err: true},
+		{header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\n", err: true},
+		{header: "GET / HTTP/1.1\r\n", err: true},
+		{header: "PROXY " + strings.Repeat("A", proxyV1MaxLength), err: true},
+		{header: v2(1, 0x11, 192, 168, 0, 1), err: true},
+		{header: v2(2, 0x11), err: true},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.header + "data"))
+		remote, local, err := readProxyHeader(r)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expect error", test.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.header, err)
+			continue
+		}
+		if test.remote == "" {
+			if remote != nil || local != nil {
+				t.Errorf("%q: got %v %v, want no address", test.header, remote, local)
+			}
+		} else if remote == nil || remote.String() != test.remote || local.String() != test.local {
+			t.Errorf("%q: got %v %v, want %s %s", test.header, remote, local, test.remote, test.local)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "data" {
+			t.Errorf("%q: got %q after header, want %q", test.header, rest, "data")
+		}
+	}
+}
+
+func TestTCPServer_ProxyProtocol(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	server := CreateTCPServerWithConfig(&Config{
+		ProxyProtocol: &ProxyProtocol{
+			TrustedNetworks: []*net.IPNet{loopback},
+			Timeout:         100 * time.Millisecond,
+		},
+		AcceptLimits: &AcceptLimits{MaxConnsPerIP: 1},
+	})
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	addr := server.Addr().String()
+
+	dial := func(header string) func() (net.Conn, error) {
+		return func() (net.Conn, error) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := conn.Write([]byte(header)); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+
+	// 每个IP的连接数按PROXY头中的客户端地址计算
+	for _, ip := range []string{"203.0.113.7", "203.0.113.8"} {
+		client := CreateTCPClient()
+		conn, _, err := client.ConnectWith(dial("PROXY TCP4 " + ip + " 127.0.0.1 4000 443\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Disconnect()
+		conn.Send([]byte("hello"))
+
+		event := waitEvent(t, serverEvents, EventConnected)
+		if got, want := event.Conn.RemoteAddr().String(), ip+":4000"; got != want {
+			t.Fatalf("got RemoteAddr %s, want %s", got, want)
+		}
+		if data := <-event.Conn.ReceiveDataChan(); !bytes.Equal(data, []byte("hello")) {
+			t.Fatalf("got %q, want %q", data, "hello")
+		}
+	}
+
+	limited, err := dial("PROXY TCP4 203.0.113.7 127.0.0.1 4001 443\r\n")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer limited.Close()
+	if event := waitEvent(t, serverEvents, EventRejected); event.Err != ErrTooManyConnsPerIP || event.Addr.String() != "203.0.113.7:4001" {
+		t.Fatal("unexpected event:", event.Err, event.Addr)
+	}
+
+	// 超时前没有发送PROXY头
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	if event := waitEvent(t, serverEvents, EventRejected); event.Err != ErrInvalidProxyHeader {
+		t.Fatal("expect ErrInvalidProxyHeader, got", event.Err)
+	}
+
+	stats := server.Stats()
+	if stats.Rejected["ip_limit"] != 1 || stats.Rejected["proxy_header"] != 1 {
+		t.Fatal("unexpected rejected:", stats.Rejected)
+	}
+}
+
+func TestTCPServer_ProxyProtocolUntrusted(t *testing.T) {
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	server := CreateTCPServerWithConfig(&Config{
+		ProxyProtocol: &ProxyProtocol{TrustedNetworks: []*net.IPNet{private}},
+	})
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 4000 443\r\n"))
+
+	if event := waitEvent(t, serverEvents, EventRejected); event.Err != ErrUntrustedProxy {
+		t.Fatal("expect ErrUntrustedProxy, got", event.Err)
+	}
+}
@@ -0,0 +1,285 @@
+package rapidnet
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 未解码完的数据超过此大小时, 处理完后释放缓冲区, 避免空闲连接占用内存
+const maxIdleInputBuffer = 4096
+
+// 用于区分重复使用的fd
+var lastPollGeneration int32
+
+// reactor EventLoops模式下服务器的事件循环, 新连接按顺序分配给各个事件循环
+type reactor struct {
+	loops []*eventLoop
+	next  uint32
+}
+
+// newReactor 创建n个事件循环, 当前平台不支持时返回nil
+func newReactor(n int, heartbeatInterval time.Duration) *reactor {
+	if n <= 0 {
+		return nil
+	}
+	r := &reactor{}
+	for i := 0; i < n; i++ {
+		l, err := newEventLoop(heartbeatInterval)
+		if err != nil {
+			r.stop()
+			return nil
+		}
+		r.loops = append(r.loops, l)
+		go l.run()
+	}
+	return r
+}
+
+// register 将已登记到服务器的连接交给事件循环, 并通知EventConnected.
+// unread为旧进程交出连接时已读取但还没有处理的数据, 在开始读取之前处理.
+// 连接不能使用EventLoops模式时返回false, 由调用者使用goroutine模式
+func (r *reactor) register(c *Connection, unread []byte) bool {
+	tcpConn, ok := c.conn.(*net.TCPConn)
+	if !ok {
+		return false
+	}
+	decoder, ok := c.packetHandler.(FrameDecoder)
+	if !ok {
+		return false
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	l := r.loops[atomic.AddUint32(&r.next, 1)%uint32(len(r.loops))]
+	c.poll = &pollState{
+		loop:    l,
+		rawConn: rawConn,
+		decoder: decoder,
+		gen:     atomic.AddInt32(&lastPollGeneration, 1),
+		paused:  true,
+	}
+	if !l.add(c) {
+		c.poll = nil
+		return false
+	}
+
+	c.notify(&Event{Type: EventConnected, Conn: c})
+	if len(unread) > 0 {
+		go c.consumeAndResume(unread)
+		return true
+	}
+	l.resume(c, nil)
+	return true
+}
+
+// stop 服务器停止后, 事件循环在所有连接断开后退出
+func (r *reactor) stop() {
+	for _, l := range r.loops {
+		l.stop()
+	}
+}
+
+// pollState EventLoops模式下连接的状态
+type pollState struct {
+	loop    *eventLoop
+	rawConn syscall.RawConn
+	decoder FrameDecoder
+
+	fd    int
+	gen   int32  // 区分重复使用的fd
+	inbuf []byte // 未解码完的数据
+
+	paused   bool // 由loop.mutex保护. 暂停读取, 由其它goroutine处理数据
+	finished bool // 由loop.mutex保护
+
+	writing    int32      // 有goroutine正在发送队列中的数据
+	writeMutex sync.Mutex // 保证同时只有一个goroutine写入连接
+}
+
+// kick EventLoops模式下启动goroutine发送队列中的数据, 队列为空时goroutine退出
+func (c *Connection) kick() {
+	if c.poll != nil && atomic.CompareAndSwapInt32(&c.poll.writing, 0, 1) {
+		go c.writeLoop()
+	}
+}
+
+func (c *Connection) writeLoop() {
+	for {
+		if err := c.writeQueued(); err != nil {
+			// 包处理器发送失败时会关闭连接, 不再启动发送goroutine
+			c.sendFailed(err)
+			return
+		}
+
+		atomic.StoreInt32(&c.poll.writing, 0)
+		if len(c.sendDataChan) == 0 || !atomic.CompareAndSwapInt32(&c.poll.writing, 0, 1) {
+			return
+		}
+	}
+}
+
+// writeQueued 发送队列中的数据后flush. 设置了flushDelay时等待flushDelay后再发送期间放入队列的数据
+func (c *Connection) writeQueued() error {
+	c.poll.writeMutex.Lock()
+	defer c.poll.writeMutex.Unlock()
+
+	if c.isClosed() {
+		return nil
+	}
+
+	select {
+	case p := <-c.sendDataChan:
+		if err := c.writeBatch(p); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	if c.flushDelay > 0 {
+		timer := time.NewTimer(c.flushDelay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-c.stopSendLoopChan:
+			return nil
+		}
+
+		select {
+		case p := <-c.sendDataChan:
+			if err := c.writeBatch(p); err != nil {
+				return err
+			}
+		default:
+		}
+	}
+	return c.packetHandler.Flush()
+}
+
+// drain EventLoops模式下关闭服务器时, 发送完队列中的数据后断开连接
+func (c *Connection) drain() {
+	c.poll.writeMutex.Lock()
+	c.flushSendQueue()
+	c.poll.writeMutex.Unlock()
+
+	c.disconnect(ErrServerClosed)
+}
+
+// sendHeartbeatAsync EventLoops模式下将心跳包放入发送队列, 队列已满时不发送
+func (c *Connection) sendHeartbeatAsync() {
+	select {
+	case c.sendDataChan <- outgoing{}:
+		c.kick()
+	default:
+	}
+}
+
+// checkIdle EventLoops模式下由事件循环定期调用, 空闲超过心跳间隔时发送心跳包
+func (c *Connection) checkIdle() {
+	if due, _ := c.heartbeatDue(); due {
+		c.sendHeartbeatAsync()
+	}
+}
+
+// stopping 连接是否已断开
+func (c *Connection) stopping() bool {
+	select {
+	case <-c.stopCmdChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// canDeliver 向上层传递数据包是否不会阻塞
+func (c *Connection) canDeliver() bool {
+	return c.handler != nil || len(c.receiveDataChan) < cap(c.receiveDataChan)
+}
+
+// consume 解码buf中完整的数据包并交给上层, 返回消耗的字节数.
+// wait为false时不阻塞, 遇到需要等待的数据包(接收队列已满或需要延迟)时停止, 返回该数据包及需要延迟的时间
+func (c *Connection) consume(buf []byte, wait bool) (n int, blocked []byte, delay time.Duration, err error) {
+	for !c.stopping() {
+		data, m, err := c.poll.decoder.DecodeFrame(buf[n:])
+		if err != nil || m == 0 {
+			return n, nil, 0, err
+		}
+		n += m
+
+		if c.onReceive(data) {
+			c.releasePacket(data)
+			continue
+		}
+		c.stats.packetIn(len(data))
+		ok, d := c.checkLimit(data)
+		if !ok {
+			c.releasePacket(data)
+			continue
+		}
+		if !wait && (d > 0 || !c.canDeliver()) {
+			return n, data, d, nil
+		}
+		if d > 0 && !c.sleep(d) {
+			c.releasePacket(data)
+			continue
+		}
+		c.deliver(data)
+	}
+	return n, nil, 0, nil
+}
+
+// keepInput 保存未解码完的数据
+func (c *Connection) keepInput(rest []byte) {
+	if len(rest) == 0 && cap(c.poll.inbuf) > maxIdleInputBuffer {
+		c.poll.inbuf = nil
+		return
+	}
+	c.poll.inbuf = append(c.poll.inbuf[:0], rest...)
+}
+
+// resume 事件循环暂停读取后, 在goroutine中等待并交给上层data, 处理剩余的数据后恢复读取
+func (c *Connection) resume(data []byte, d time.Duration, rest []byte) {
+	if d == 0 || c.sleep(d) {
+		c.deliver(data)
+	} else {
+		c.releasePacket(data)
+	}
+
+	c.consumeAndResume(rest)
+}
+
+// consumeAndResume 在goroutine中交给上层rest中完整的数据包, 保存剩余的数据后恢复读取
+func (c *Connection) consumeAndResume(rest []byte) {
+	n, _, _, err := c.consume(rest, true)
+	c.keepInput(rest[n:])
+	c.poll.loop.resume(c, err)
+}
+
+// finish EventLoops模式下连接结束, 与goroutine模式下loop退出时相同.
+// 可能在事件循环中调用, 事件chan已满时在新的goroutine中等待发送EventDisconnected, 不阻塞事件循环
+func (c *Connection) finish(err error) {
+	if c.stopping() {
+		err = c.stopErr
+	}
+	close(c.stopSendLoopChan)
+	c.conn.Close()
+	c.leaveGroups()
+	c.stats.disconnected(err)
+	e := &Event{Type: EventDisconnected, Err: err, Conn: c}
+	if c.handler != nil {
+		c.notify(e)
+	} else {
+		select {
+		case c.eventChan <- e:
+		default:
+			go func() { c.eventChan <- e }()
+		}
+	}
+	close(c.receiveDataChan)
+	c.release()
+}
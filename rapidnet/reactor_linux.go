@@ -0,0 +1,266 @@
+package rapidnet
+
+import (
+	"io"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 事件循环每次读取的最大字节数
+const eventLoopReadSize = 64 * 1024
+
+// 用于唤醒事件循环
+var wakeupByte = []byte{0}
+
+// eventLoop 通过epoll读取一组连接. 连接使用水平触发, 每次可读时读取一次, 解码出的数据包在事件循环中交给上层
+type eventLoop struct {
+	epfd   int
+	wakeup [2]int // 唤醒事件循环的pipe
+
+	heartbeatInterval time.Duration
+
+	mutex   sync.Mutex
+	conns   map[int]*Connection // fd -> 连接
+	closing []*Connection       // 已断开等待清理的连接
+	stopped bool
+
+	buf []byte
+}
+
+func newEventLoop(heartbeatInterval time.Duration) (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &eventLoop{
+		epfd:              epfd,
+		heartbeatInterval: heartbeatInterval,
+		conns:             make(map[int]*Connection),
+		buf:               make([]byte, eventLoopReadSize),
+	}
+	if err := syscall.Pipe2(l.wakeup[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(l.wakeup[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, l.wakeup[0], &ev); err != nil {
+		l.close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *eventLoop) close() {
+	syscall.Close(l.wakeup[0])
+	syscall.Close(l.wakeup[1])
+	syscall.Close(l.epfd)
+}
+
+func (l *eventLoop) wake() {
+	syscall.Write(l.wakeup[1], wakeupByte)
+}
+
+// add 登记连接, 连接处于暂停读取的状态, 需要调用resume开始读取. 事件循环已停止时返回false
+func (l *eventLoop) add(c *Connection) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.stopped {
+		return false
+	}
+	err := c.poll.rawConn.Control(func(fd uintptr) {
+		c.poll.fd = int(fd)
+	})
+	if err != nil {
+		return false
+	}
+	l.conns[c.poll.fd] = c
+	return true
+}
+
+// resume 开始或恢复读取连接, err不为nil或连接已断开时结束连接
+func (l *eventLoop) resume(c *Connection, err error) {
+	if err == nil && !c.stopping() {
+		l.mutex.Lock()
+		c.poll.paused = false
+		// 在Control中操作fd, 保证fd没有被关闭及重复使用
+		cerr := c.poll.rawConn.Control(func(fd uintptr) {
+			ev := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(fd), Pad: c.poll.gen}
+			err = syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, int(fd), &ev)
+		})
+		l.mutex.Unlock()
+		if cerr != nil {
+			err = cerr
+		}
+		if err == nil {
+			return
+		}
+	}
+	l.finish(c, err)
+}
+
+// pause 暂停读取连接, 由其它goroutine处理数据后调用resume
+func (l *eventLoop) pause(c *Connection) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	c.poll.paused = true
+	c.poll.rawConn.Control(func(fd uintptr) {
+		syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, int(fd), nil)
+	})
+}
+
+// closed 连接已断开, 由事件循环清理. 暂停读取的连接由处理数据的goroutine清理
+func (l *eventLoop) closed(c *Connection) {
+	l.mutex.Lock()
+	l.closing = append(l.closing, c)
+	l.mutex.Unlock()
+	l.wake()
+}
+
+// finish 结束连接, 每个连接只执行一次
+func (l *eventLoop) finish(c *Connection, err error) {
+	l.mutex.Lock()
+	if c.poll.finished {
+		l.mutex.Unlock()
+		return
+	}
+	c.poll.finished = true
+	if l.conns[c.poll.fd] == c {
+		delete(l.conns, c.poll.fd)
+	}
+	stopped := l.stopped
+	l.mutex.Unlock()
+
+	c.finish(err)
+	if stopped {
+		l.wake()
+	}
+}
+
+func (l *eventLoop) stop() {
+	l.mutex.Lock()
+	l.stopped = true
+	l.mutex.Unlock()
+	l.wake()
+}
+
+// run 服务器停止且所有连接都结束后退出
+func (l *eventLoop) run() {
+	defer l.close()
+
+	events := make([]syscall.EpollEvent, 256)
+	var nextCheck time.Time
+	if l.heartbeatInterval > 0 {
+		nextCheck = time.Now().Add(l.heartbeatInterval)
+	}
+
+	for {
+		timeout := -1
+		if !nextCheck.IsZero() {
+			timeout = int(time.Until(nextCheck)/time.Millisecond) + 1
+		}
+		n, err := syscall.EpollWait(l.epfd, events, timeout)
+		if err != nil && err != syscall.EINTR {
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == l.wakeup[0] {
+				var b [64]byte
+				syscall.Read(fd, b[:])
+				continue
+			}
+
+			l.mutex.Lock()
+			c := l.conns[fd]
+			ready := c != nil && c.poll.gen == events[i].Pad && !c.poll.paused && !c.poll.finished
+			l.mutex.Unlock()
+			if ready {
+				l.read(c)
+			}
+		}
+
+		l.mutex.Lock()
+		closing := l.closing
+		l.closing = nil
+		l.mutex.Unlock()
+		for _, c := range closing {
+			l.mutex.Lock()
+			paused := c.poll.paused
+			l.mutex.Unlock()
+			if !paused {
+				l.finish(c, nil)
+			}
+		}
+
+		if !nextCheck.IsZero() && !time.Now().Before(nextCheck) {
+			nextCheck = time.Now().Add(l.heartbeatInterval)
+			l.mutex.Lock()
+			conns := make([]*Connection, 0, len(l.conns))
+			for _, c := range l.conns {
+				conns = append(conns, c)
+			}
+			l.mutex.Unlock()
+			for _, c := range conns {
+				c.checkIdle()
+			}
+		}
+
+		l.mutex.Lock()
+		exit := l.stopped && len(l.conns) == 0
+		l.mutex.Unlock()
+		if exit {
+			return
+		}
+	}
+}
+
+// read 读取一次连接并处理完整的数据包
+func (l *eventLoop) read(c *Connection) {
+	var n int
+	var err error
+	if cerr := c.poll.rawConn.Read(func(fd uintptr) bool {
+		n, err = syscall.Read(int(fd), l.buf)
+		return true
+	}); cerr != nil {
+		err = cerr
+	}
+	if n <= 0 {
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			return
+		}
+		if err == nil {
+			err = io.EOF
+		}
+		l.finish(c, err)
+		return
+	}
+
+	data := l.buf[:n]
+	if len(c.poll.inbuf) > 0 {
+		c.poll.inbuf = append(c.poll.inbuf, data...)
+		data = c.poll.inbuf
+	}
+
+	m, blocked, d, err := c.consume(data, false)
+	if err != nil {
+		l.finish(c, err)
+		return
+	}
+	if blocked != nil {
+		rest := append([]byte(nil), data[m:]...)
+		c.poll.inbuf = nil
+		l.pause(c)
+		go c.resume(blocked, d, rest)
+		return
+	}
+
+	c.keepInput(data[m:])
+	if c.stopping() {
+		l.finish(c, nil)
+	}
+}
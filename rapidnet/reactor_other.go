@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package rapidnet
+
+import (
+	"errors"
+	"time"
+)
+
+// eventLoop 当前平台不支持EventLoops模式, 服务器使用goroutine模式
+type eventLoop struct{}
+
+func newEventLoop(heartbeatInterval time.Duration) (*eventLoop, error) {
+	return nil, errors.New("rapidnet: event loops are not supported on this platform")
+}
+
+func (l *eventLoop) run()                            {}
+func (l *eventLoop) stop()                           {}
+func (l *eventLoop) add(c *Connection) bool          { return false }
+func (l *eventLoop) resume(c *Connection, err error) {}
+func (l *eventLoop) closed(c *Connection)            {}
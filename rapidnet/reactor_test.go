@@ -0,0 +1,234 @@
+package rapidnet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestTCPServer_EventLoops(t *testing.T) {
+	const count = 100
+	server := CreateTCPServerWithConfig(&Config{EventLoops: 2, SendQueueSize: count})
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, clientEvents, err := CreateTCPClientWithConfig(&Config{SendQueueSize: count}).Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := waitEvent(t, serverEvents, EventConnected).Conn
+
+	// 接收队列已满时暂停读取, 上层读取后继续
+	for i := 0; i < count; i++ {
+		client.Send([]byte(fmt.Sprint(i)))
+	}
+	time.Sleep(time.Millisecond * 20)
+	for i := 0; i < count; i++ {
+		data := <-conn.ReceiveDataChan()
+		if string(data) != fmt.Sprint(i) {
+			t.Fatal("unexpected data:", string(data))
+		}
+		conn.Send(data)
+	}
+	for i := 0; i < count; i++ {
+		if data := <-client.ReceiveDataChan(); string(data) != fmt.Sprint(i) {
+			t.Fatal("unexpected data:", string(data))
+		}
+	}
+	if stats := conn.Stats(); stats.PacketsIn != count || stats.PacketsOut != count {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	conn.Disconnect()
+	if event := waitEvent(t, serverEvents, EventDisconnected); event.Err != errStopped {
+		t.Fatal("unexpected error:", event.Err)
+	}
+	waitEvent(t, clientEvents, EventDisconnected)
+
+	client, _, err = CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = waitEvent(t, serverEvents, EventConnected).Conn
+	conn.Send([]byte("bye"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- server.Shutdown(ctx) }()
+
+	if event := waitEvent(t, serverEvents, EventDisconnected); event.Err != ErrServerClosed {
+		t.Fatal("unexpected error:", event.Err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Shutdown:", err)
+	}
+	if data := <-client.ReceiveDataChan(); string(data) != "bye" {
+		t.Fatal("unexpected data:", string(data))
+	}
+}
+
+func TestTCPServer_EventLoopsHeartbeat(t *testing.T) {
+	server := CreateTCPServerWithConfig(&Config{
+		EventLoops:         1,
+		HeartbeatInterval:  time.Millisecond * 20,
+		HeartbeatMaxMissed: 2,
+	})
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// 客户端启用心跳, 连接保持
+	client, _, err := CreateTCPClientWithConfig(&Config{HeartbeatInterval: time.Millisecond * 20}).Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	waitEvent(t, serverEvents, EventConnected)
+
+	// 客户端不回复心跳, 连接超时
+	idle, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Disconnect()
+	waitEvent(t, serverEvents, EventConnected)
+	go func() {
+		for range idle.ReceiveDataChan() {
+		}
+	}()
+
+	if event := waitEvent(t, serverEvents, EventDisconnected); event.Err != ErrIdleTimeout {
+		t.Fatal("expect ErrIdleTimeout, got", event.Err)
+	}
+	if n := server.Stats().ActiveConnections; n < 1 {
+		t.Fatal("expect heartbeat connection alive")
+	}
+}
+
+type echoHandler struct{}
+
+func (echoHandler) OnConnected(conn *Connection)               {}
+func (echoHandler) OnPacket(conn *Connection, data []byte)     { conn.Send(data) }
+func (echoHandler) OnDisconnected(conn *Connection, err error) {}
+func (echoHandler) OnSendFailed(conn *Connection, err error)   {}
+
+func benchmarkModes(b *testing.B, f func(b *testing.B, cfg *Config)) {
+	b.Run("Goroutines", func(b *testing.B) { f(b, &Config{}) })
+	b.Run("EventLoops", func(b *testing.B) { f(b, &Config{EventLoops: runtime.NumCPU()}) })
+}
+
+func BenchmarkTCPServer_Echo(b *testing.B) {
+	benchmarkModes(b, func(b *testing.B, cfg *Config) {
+		server := CreateTCPServerWithConfig(cfg)
+		if err := server.StartWithHandler("127.0.0.1:0", 10, echoHandler{}); err != nil {
+			b.Fatal(err)
+		}
+		defer server.Stop()
+
+		client, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer client.Disconnect()
+
+		data := make([]byte, 128)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			client.Send(data)
+			<-client.ReceiveDataChan()
+		}
+	})
+}
+
+// BenchmarkTCPServer_IdleConnections 报告每个空闲连接在服务器端占用的goroutine数量
+func BenchmarkTCPServer_IdleConnections(b *testing.B) {
+	const conns = 200
+	benchmarkModes(b, func(b *testing.B, cfg *Config) {
+		var goroutines int
+		for i := 0; i < b.N; i++ {
+			before := runtime.NumGoroutine()
+			server := CreateTCPServerWithConfig(cfg)
+			serverEvents, err := server.Start("127.0.0.1:0", conns)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var clients []<-chan *Event
+			for j := 0; j < conns; j++ {
+				_, clientEvents, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+				if err != nil {
+					b.Fatal(err)
+				}
+				clients = append(clients, clientEvents)
+				<-serverEvents
+			}
+			// 每个客户端连接有两个goroutine
+			goroutines += runtime.NumGoroutine() - before - 2*conns
+
+			go func() {
+				for range serverEvents {
+				}
+			}()
+			server.Shutdown(context.Background())
+			for _, clientEvents := range clients {
+				for event := range clientEvents {
+					if event.Type == EventDisconnected {
+						break
+					}
+				}
+			}
+		}
+		b.ReportMetric(float64(goroutines)/float64(b.N*conns), "goroutines/conn")
+	})
+}
+
+// 事件chan已满时事件循环继续处理其它连接
+func TestTCPServer_EventLoopsSlowConsumer(t *testing.T) {
+	server := CreateTCPServerWithConfig(&Config{EventLoops: 1})
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client1, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, serverEvents, EventConnected)
+	client2, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Disconnect()
+	conn2 := waitEvent(t, serverEvents, EventConnected).Conn
+
+	for len(server.eventChan) < cap(server.eventChan) {
+		server.eventChan <- &Event{Type: EventSendFailed}
+	}
+	client1.Disconnect()
+	time.Sleep(time.Millisecond * 20)
+
+	client2.Send([]byte("hello"))
+	select {
+	case data := <-conn2.ReceiveDataChan():
+		if string(data) != "hello" {
+			t.Fatal("unexpected data:", string(data))
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("event loop blocked")
+	}
+
+	if event := waitEvent(t, serverEvents, EventDisconnected); event.Err != io.EOF {
+		t.Fatal("unexpected error:", event.Err)
+	}
+}
@@ -0,0 +1,70 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// 消息类型, 保存在Flags的低2位
+const (
+	// FlagRequest 请求, 需要回复
+	FlagRequest byte = 0x01
+
+	// FlagResponse 回复, Seq与请求相同
+	FlagResponse byte = 0x02
+
+	// FlagNotify 通知, 不需要回复
+	FlagNotify byte = 0x03
+
+	// FlagError 回复表示错误, Payload为错误信息
+	FlagError byte = 0x80
+
+	kindMask byte = 0x03
+)
+
+// EnvelopeHeaderSize 信封头的字节数: Flags(1) + Seq(4) + Method(4)
+const EnvelopeHeaderSize = 9
+
+// ErrInvalidEnvelope 数据包太短, 不是合法的信封
+var ErrInvalidEnvelope = errors.New("rpc: invalid envelope")
+
+// Envelope 包装在数据包中的rpc消息, 与PacketHandler的封包格式无关
+type Envelope struct {
+	Flags   byte
+	Seq     uint32
+	Method  uint32
+	Payload []byte
+}
+
+// Kind 返回消息类型: FlagRequest, FlagResponse或FlagNotify
+func (e *Envelope) Kind() byte {
+	return e.Flags & kindMask
+}
+
+// IsError 是否是错误回复
+func (e *Envelope) IsError() bool {
+	return e.Flags&FlagError != 0
+}
+
+// Encode 将信封编码为数据包
+func (e *Envelope) Encode() []byte {
+	p := make([]byte, EnvelopeHeaderSize+len(e.Payload))
+	p[0] = e.Flags
+	binary.BigEndian.PutUint32(p[1:], e.Seq)
+	binary.BigEndian.PutUint32(p[5:], e.Method)
+	copy(p[EnvelopeHeaderSize:], e.Payload)
+	return p
+}
+
+// DecodeEnvelope 从数据包解码信封, Payload引用data中的数据
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	if len(data) < EnvelopeHeaderSize {
+		return nil, ErrInvalidEnvelope
+	}
+	return &Envelope{
+		Flags:   data[0],
+		Seq:     binary.BigEndian.Uint32(data[1:]),
+		Method:  binary.BigEndian.Uint32(data[5:]),
+		Payload: data[EnvelopeHeaderSize:],
+	}, nil
+}
@@ -0,0 +1,193 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lzhig/rapidgo/rapidnet"
+)
+
+// ErrClosed Peer已关闭或连接已断开
+var ErrClosed = errors.New("rpc: closed")
+
+// RemoteError 对端返回的错误
+type RemoteError struct {
+	Method  uint32
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("rpc: method %d: %s", e.Method, e.Message)
+}
+
+// Request 收到的请求或通知
+type Request struct {
+	Peer   *Peer
+	Method uint32
+	Data   []byte
+
+	seq     uint32
+	notify  bool
+	replied int32
+}
+
+// IsNotify 是否是通知, 通知不需要回复
+func (req *Request) IsNotify() bool {
+	return req.notify
+}
+
+// Reply 回复请求, 可以在其它goroutine中调用. 通知或重复回复时忽略
+func (req *Request) Reply(data []byte) {
+	if req.notify || !atomic.CompareAndSwapInt32(&req.replied, 0, 1) {
+		return
+	}
+	req.Peer.send(&Envelope{Flags: FlagResponse, Seq: req.seq, Method: req.Method, Payload: data})
+}
+
+// Error 以错误回复请求
+func (req *Request) Error(err error) {
+	if req.notify || !atomic.CompareAndSwapInt32(&req.replied, 0, 1) {
+		return
+	}
+	req.Peer.send(&Envelope{Flags: FlagResponse | FlagError, Seq: req.seq, Method: req.Method, Payload: []byte(err.Error())})
+}
+
+// Peer 在rapidnet.Connection上进行rpc调用, 客户端及服务端都可以发起调用及通知
+type Peer struct {
+	conn     *rapidnet.Connection
+	registry *Registry
+
+	seq     uint32
+	mutex   sync.Mutex
+	pending map[uint32]chan *Envelope // 等待回复的调用
+
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPeer 创建Peer. registry处理对端发来的请求及通知, 可以为nil
+func NewPeer(conn *rapidnet.Connection, registry *Registry) *Peer {
+	return &Peer{
+		conn:      conn,
+		registry:  registry,
+		pending:   make(map[uint32]chan *Envelope),
+		closeChan: make(chan struct{}),
+	}
+}
+
+// Connection 返回底层连接
+func (p *Peer) Connection() *rapidnet.Connection {
+	return p.conn
+}
+
+// Serve 读取连接收到的数据并处理, 直到连接断开, 然后关闭Peer.
+// 使用rapidnet.Handler时不需要调用Serve, 在OnPacket中调用Dispatch, 在OnDisconnected中调用Close.
+func (p *Peer) Serve() {
+	defer p.Close()
+
+	for data := range p.conn.ReceiveDataChan() {
+		p.Dispatch(data)
+	}
+}
+
+// Dispatch 处理一个收到的数据包. 请求及通知的处理函数在当前goroutine中调用,
+// 处理函数中不能同步调用同一个Peer的Call, 否则会阻塞回复的处理
+func (p *Peer) Dispatch(data []byte) error {
+	env, err := DecodeEnvelope(data)
+	if err != nil {
+		return err
+	}
+
+	switch env.Kind() {
+	case FlagResponse:
+		p.mutex.Lock()
+		ch, ok := p.pending[env.Seq]
+		delete(p.pending, env.Seq)
+		p.mutex.Unlock()
+		if ok {
+			ch <- env
+		}
+
+	case FlagRequest, FlagNotify:
+		req := &Request{Peer: p, Method: env.Method, Data: env.Payload, seq: env.Seq, notify: env.Kind() == FlagNotify}
+		if p.registry == nil || !p.registry.handle(req) {
+			req.Error(fmt.Errorf("method %d not found", env.Method))
+		}
+
+	default:
+		return ErrInvalidEnvelope
+	}
+	return nil
+}
+
+// Call 调用对端的method并等待回复, 超时及取消由ctx控制
+func (p *Peer) Call(ctx context.Context, method uint32, req []byte) ([]byte, error) {
+	seq := atomic.AddUint32(&p.seq, 1)
+	ch := make(chan *Envelope, 1)
+
+	p.mutex.Lock()
+	select {
+	case <-p.closeChan:
+		p.mutex.Unlock()
+		return nil, ErrClosed
+	default:
+	}
+	p.pending[seq] = ch
+	p.mutex.Unlock()
+
+	if err := p.send(&Envelope{Flags: FlagRequest, Seq: seq, Method: method, Payload: req}); err != nil {
+		p.mutex.Lock()
+		delete(p.pending, seq)
+		p.mutex.Unlock()
+		return nil, err
+	}
+
+	select {
+	case env := <-ch:
+		if env.IsError() {
+			return nil, &RemoteError{Method: method, Message: string(env.Payload)}
+		}
+		return env.Payload, nil
+
+	case <-ctx.Done():
+		p.mutex.Lock()
+		delete(p.pending, seq)
+		p.mutex.Unlock()
+		return nil, ctx.Err()
+
+	case <-p.closeChan:
+		return nil, ErrClosed
+	}
+}
+
+// Notify 向对端发送通知, 不等待回复
+func (p *Peer) Notify(method uint32, data []byte) error {
+	select {
+	case <-p.closeChan:
+		return ErrClosed
+	default:
+	}
+
+	return p.send(&Envelope{Flags: FlagNotify, Method: method, Payload: data})
+}
+
+// Close 关闭Peer, 等待中的调用返回ErrClosed. 不会断开连接
+func (p *Peer) Close() {
+	p.closeOnce.Do(func() {
+		p.mutex.Lock()
+		close(p.closeChan)
+		p.pending = make(map[uint32]chan *Envelope)
+		p.mutex.Unlock()
+	})
+}
+
+func (p *Peer) send(env *Envelope) error {
+	err := p.conn.Send(env.Encode())
+	if err == rapidnet.ErrConnClosed {
+		return ErrClosed
+	}
+	return err
+}
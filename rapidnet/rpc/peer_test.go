@@ -0,0 +1,78 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lzhig/rapidgo/rapidnet"
+)
+
+const (
+	methodEcho uint32 = iota + 1
+	methodNever
+	methodPush
+)
+
+func TestPeer(t *testing.T) {
+	server := rapidnet.CreateTCPServer()
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	serverRegistry := NewRegistry()
+	serverRegistry.Register(methodEcho, func(req *Request) {
+		req.Reply(req.Data)
+		req.Peer.Notify(methodPush, []byte("pushed"))
+	})
+	serverRegistry.Register(methodNever, func(req *Request) {})
+
+	pushed := make(chan []byte, 1)
+	clientRegistry := NewRegistry()
+	clientRegistry.Register(methodPush, func(req *Request) {
+		if !req.IsNotify() {
+			t.Error("expect notify")
+		}
+		pushed <- req.Data
+	})
+
+	client := rapidnet.CreateTCPClient()
+	conn, _, err := client.Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPeer := NewPeer(conn, clientRegistry)
+	go clientPeer.Serve()
+
+	event := <-serverEvents
+	go NewPeer(event.Conn, serverRegistry).Serve()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := clientPeer.Call(ctx, methodEcho, []byte("hello"))
+	if err != nil || string(resp) != "hello" {
+		t.Fatal("unexpected response:", resp, err)
+	}
+	if data := <-pushed; string(data) != "pushed" {
+		t.Fatal("unexpected notify:", data)
+	}
+
+	var remoteErr *RemoteError
+	if _, err := clientPeer.Call(ctx, 100, nil); !errors.As(err, &remoteErr) {
+		t.Fatal("expect RemoteError, got", err)
+	}
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer timeoutCancel()
+	if _, err := clientPeer.Call(timeoutCtx, methodNever, nil); err != context.DeadlineExceeded {
+		t.Fatal("expect DeadlineExceeded, got", err)
+	}
+
+	client.Disconnect()
+	if _, err := clientPeer.Call(ctx, methodEcho, nil); err != ErrClosed {
+		t.Fatal("expect ErrClosed, got", err)
+	}
+}
@@ -0,0 +1,32 @@
+package rpc
+
+import (
+	"github.com/lzhig/rapidgo/base"
+)
+
+// HandlerFunc 处理请求或通知
+type HandlerFunc func(req *Request)
+
+// Registry 按method id注册处理函数. 注册需要在开始处理消息之前完成
+type Registry struct {
+	handlers base.MessageHandlerImpl
+}
+
+// NewRegistry 创建Registry
+func NewRegistry() *Registry {
+	r := &Registry{}
+	r.handlers.Init()
+	return r
+}
+
+// Register 注册method的处理函数
+func (r *Registry) Register(method uint32, f HandlerFunc) {
+	r.handlers.SetMessageHandler(method, func(v interface{}) {
+		f(v.(*Request))
+	})
+}
+
+// handle 调用method的处理函数, 没有注册时返回false
+func (r *Registry) handle(req *Request) bool {
+	return r.handlers.Handle(req.Method, req)
+}
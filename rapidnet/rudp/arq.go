@@ -0,0 +1,504 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// 数据报由一个或多个segment组成, segment的头部(小端):
+// conv(4) cmd(1) frg(1) wnd(2) ts(4) sn(4) una(4) len(4)
+const headerSize = 24
+
+const (
+	cmdPush = 81 // 数据
+	cmdAck  = 82 // 确认
+	cmdWask = 83 // 询问对端的接收窗口
+	cmdWins = 84 // 告知接收窗口
+	cmdFin  = 85 // 关闭, 与数据一样按序号重传及确认
+)
+
+const (
+	askSend = 1 << iota // 需要发送cmdWask
+	askTell             // 需要发送cmdWins
+)
+
+const (
+	maxRTO      = 60000
+	probeInit   = 1000  // 对端接收窗口为0时, 第一次询问的等待时间
+	probeLimit  = 60000 // 询问的最大间隔
+	deadLink    = 20    // 一个segment重传超过此次数时认为连接已断开
+	minSsthresh = 2
+)
+
+var errInvalidSegment = errors.New("rudp: invalid segment")
+
+type header struct {
+	conv uint32
+	cmd  uint8
+	wnd  uint16
+	ts   uint32
+	sn   uint32
+	una  uint32
+}
+
+func appendSegment(b []byte, h header, data []byte) []byte {
+	var p [headerSize]byte
+	binary.LittleEndian.PutUint32(p[0:], h.conv)
+	p[4] = h.cmd
+	binary.LittleEndian.PutUint16(p[6:], h.wnd)
+	binary.LittleEndian.PutUint32(p[8:], h.ts)
+	binary.LittleEndian.PutUint32(p[12:], h.sn)
+	binary.LittleEndian.PutUint32(p[16:], h.una)
+	binary.LittleEndian.PutUint32(p[20:], uint32(len(data)))
+	return append(append(b, p[:]...), data...)
+}
+
+func decodeHeader(b []byte) (header, []byte, []byte, error) {
+	if len(b) < headerSize {
+		return header{}, nil, nil, errInvalidSegment
+	}
+	h := header{
+		conv: binary.LittleEndian.Uint32(b[0:]),
+		cmd:  b[4],
+		wnd:  binary.LittleEndian.Uint16(b[6:]),
+		ts:   binary.LittleEndian.Uint32(b[8:]),
+		sn:   binary.LittleEndian.Uint32(b[12:]),
+		una:  binary.LittleEndian.Uint32(b[16:]),
+	}
+	n := binary.LittleEndian.Uint32(b[20:])
+	if uint32(len(b)-headerSize) < n {
+		return header{}, nil, nil, errInvalidSegment
+	}
+	return h, b[headerSize : headerSize+int(n)], b[headerSize+int(n):], nil
+}
+
+// diff 返回a-b, 序号及时间戳回绕后仍然正确
+func diff(a, b uint32) int32 {
+	return int32(a - b)
+}
+
+type segment struct {
+	cmd      uint8 // cmdPush或cmdFin
+	sn       uint32
+	ts       uint32 // 最后一次发送的时间
+	resendts uint32 // 超时重传的时间
+	rto      uint32
+	xmit     uint32 // 发送次数
+	fastack  uint32 // 被后面的segment的确认跳过的次数
+	data     []byte
+}
+
+type ack struct {
+	sn uint32
+	ts uint32
+}
+
+// arq 流模式的KCP风格的自动重传, 不是并发安全的, 由Session加锁调用.
+// 时间均为毫秒, 由调用方传入
+type arq struct {
+	conv uint32
+	mtu  int
+	mss  int
+
+	sndUna uint32 // 第一个未确认的序号
+	sndNxt uint32 // 下一个发送的序号
+	rcvNxt uint32 // 下一个期望收到的序号
+
+	srtt, rttvar int32
+	rto, minRTO  uint32
+	interval     uint32
+
+	sndWnd, rcvWnd, rmtWnd uint32
+	cwnd, ssthresh, incr   uint32
+	noCongestion           bool
+	fastResend             uint32
+
+	probe     int
+	probeWait uint32
+	tsProbe   uint32
+
+	sndQueue []*segment // 等待进入发送窗口
+	sndBuf   []*segment // 已发送未确认, 按序号排列
+	rcvBuf   []*segment // 收到的乱序数据, 按序号排列
+	rcvQueue []*segment // 可以读取的数据
+	acks     []ack
+	eof      bool // 已读取到对端的cmdFin
+
+	dead bool // 重传次数过多
+
+	buf    []byte // 待输出的数据报
+	output func([]byte)
+}
+
+func newARQ(conv uint32, opts *Options, output func([]byte)) *arq {
+	return &arq{
+		conv:         conv,
+		mtu:          opts.mtu(),
+		mss:          opts.mtu() - headerSize,
+		rto:          opts.minRTO() * 4,
+		minRTO:       opts.minRTO(),
+		interval:     opts.interval(),
+		sndWnd:       opts.sendWindow(),
+		rcvWnd:       opts.receiveWindow(),
+		rmtWnd:       opts.receiveWindow(),
+		cwnd:         1,
+		ssthresh:     opts.sendWindow(),
+		incr:         uint32(opts.mtu() - headerSize),
+		noCongestion: opts != nil && opts.NoCongestion,
+		fastResend:   opts.fastResend(),
+		buf:          make([]byte, 0, opts.mtu()),
+		output:       output,
+	}
+}
+
+// send 将data放入发送队列, 与队尾未满的segment合并
+func (a *arq) send(data []byte) {
+	if n := len(a.sndQueue); n > 0 && a.sndQueue[n-1].cmd == cmdPush {
+		last := a.sndQueue[n-1]
+		if room := a.mss - len(last.data); room > 0 {
+			if room > len(data) {
+				room = len(data)
+			}
+			last.data = append(last.data, data[:room]...)
+			data = data[room:]
+		}
+	}
+	for len(data) > 0 {
+		n := a.mss
+		if n > len(data) {
+			n = len(data)
+		}
+		seg := &segment{cmd: cmdPush, data: make([]byte, n, a.mss)}
+		copy(seg.data, data)
+		a.sndQueue = append(a.sndQueue, seg)
+		data = data[n:]
+	}
+}
+
+// sendFin 在发送队列的最后放入cmdFin, 对端读取完之前的数据后读到io.EOF
+func (a *arq) sendFin() {
+	a.sndQueue = append(a.sndQueue, &segment{cmd: cmdFin})
+}
+
+// waitSnd 返回还没有被确认的segment数量
+func (a *arq) waitSnd() int {
+	return len(a.sndQueue) + len(a.sndBuf)
+}
+
+// readable 返回是否有可以读取的数据
+func (a *arq) readable() bool {
+	return len(a.rcvQueue) > 0
+}
+
+// recv 读取数据到b, 返回读取的长度
+func (a *arq) recv(b []byte) int {
+	full := uint32(len(a.rcvQueue)) >= a.rcvWnd
+
+	n := 0
+	for n < len(b) && len(a.rcvQueue) > 0 {
+		seg := a.rcvQueue[0]
+		if seg.cmd == cmdFin {
+			a.eof = true
+		}
+		m := copy(b[n:], seg.data)
+		n += m
+		seg.data = seg.data[m:]
+		if len(seg.data) == 0 {
+			a.rcvQueue[0] = nil
+			a.rcvQueue = a.rcvQueue[1:]
+		}
+	}
+	a.moveReceived()
+
+	// 接收窗口重新打开, 主动告知对端
+	if full && uint32(len(a.rcvQueue)) < a.rcvWnd {
+		a.probe |= askTell
+	}
+	return n
+}
+
+// moveReceived 将rcvBuf中连续的segment移到rcvQueue
+func (a *arq) moveReceived() {
+	for len(a.rcvBuf) > 0 {
+		seg := a.rcvBuf[0]
+		if seg.sn != a.rcvNxt || uint32(len(a.rcvQueue)) >= a.rcvWnd {
+			break
+		}
+		a.rcvBuf[0] = nil
+		a.rcvBuf = a.rcvBuf[1:]
+		a.rcvQueue = append(a.rcvQueue, seg)
+		a.rcvNxt++
+	}
+}
+
+func (a *arq) updateRTT(rtt int32) {
+	if a.srtt == 0 {
+		a.srtt = rtt
+		a.rttvar = rtt / 2
+	} else {
+		delta := rtt - a.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		a.rttvar = (3*a.rttvar + delta) / 4
+		a.srtt = (7*a.srtt + rtt) / 8
+		if a.srtt < 1 {
+			a.srtt = 1
+		}
+	}
+
+	rto := uint32(a.srtt) + umax(a.interval, uint32(4*a.rttvar))
+	a.rto = umin(umax(rto, a.minRTO), maxRTO)
+}
+
+// parseUna 删除序号小于una的已确认segment
+func (a *arq) parseUna(una uint32) {
+	i := 0
+	for i < len(a.sndBuf) && diff(una, a.sndBuf[i].sn) > 0 {
+		a.sndBuf[i] = nil
+		i++
+	}
+	a.sndBuf = a.sndBuf[i:]
+	if len(a.sndBuf) > 0 {
+		a.sndUna = a.sndBuf[0].sn
+	} else {
+		a.sndUna = a.sndNxt
+	}
+}
+
+// parseAck 删除序号为sn的segment, 并增加之前的segment被跳过的次数
+func (a *arq) parseAck(sn uint32) {
+	if diff(sn, a.sndUna) < 0 || diff(sn, a.sndNxt) >= 0 {
+		return
+	}
+	for i, seg := range a.sndBuf {
+		if seg.sn == sn {
+			copy(a.sndBuf[i:], a.sndBuf[i+1:])
+			a.sndBuf[len(a.sndBuf)-1] = nil
+			a.sndBuf = a.sndBuf[:len(a.sndBuf)-1]
+			break
+		}
+		if diff(sn, seg.sn) < 0 {
+			break
+		}
+		seg.fastack++
+	}
+	if len(a.sndBuf) > 0 {
+		a.sndUna = a.sndBuf[0].sn
+	} else {
+		a.sndUna = a.sndNxt
+	}
+}
+
+// parseData 将收到的segment按序号放入rcvBuf, 重复的丢弃
+func (a *arq) parseData(seg *segment) {
+	if diff(seg.sn, a.rcvNxt+a.rcvWnd) >= 0 || diff(seg.sn, a.rcvNxt) < 0 {
+		return
+	}
+
+	i := len(a.rcvBuf)
+	for i > 0 {
+		d := diff(seg.sn, a.rcvBuf[i-1].sn)
+		if d == 0 {
+			return
+		}
+		if d > 0 {
+			break
+		}
+		i--
+	}
+	a.rcvBuf = append(a.rcvBuf, nil)
+	copy(a.rcvBuf[i+1:], a.rcvBuf[i:])
+	a.rcvBuf[i] = seg
+
+	a.moveReceived()
+}
+
+// input 处理收到的数据报
+func (a *arq) input(data []byte, now uint32) error {
+	una := a.sndUna
+	for len(data) > 0 {
+		h, payload, rest, err := decodeHeader(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+		if h.conv != a.conv {
+			return errInvalidSegment
+		}
+
+		a.rmtWnd = uint32(h.wnd)
+		a.parseUna(h.una)
+
+		switch h.cmd {
+		case cmdAck:
+			if rtt := diff(now, h.ts); rtt >= 0 {
+				a.updateRTT(rtt)
+			}
+			a.parseAck(h.sn)
+		case cmdPush, cmdFin:
+			if diff(h.sn, a.rcvNxt+a.rcvWnd) < 0 {
+				a.acks = append(a.acks, ack{sn: h.sn, ts: h.ts})
+				if diff(h.sn, a.rcvNxt) >= 0 {
+					seg := &segment{cmd: h.cmd, sn: h.sn, data: append([]byte(nil), payload...)}
+					a.parseData(seg)
+				}
+			}
+		case cmdWask:
+			a.probe |= askTell
+		case cmdWins:
+		default:
+			return errInvalidSegment
+		}
+	}
+
+	// 有新的数据被确认时增大拥塞窗口
+	if diff(a.sndUna, una) > 0 && a.cwnd < a.rmtWnd {
+		mss := uint32(a.mss)
+		if a.cwnd < a.ssthresh {
+			a.cwnd++
+			a.incr += mss
+		} else {
+			if a.incr < mss {
+				a.incr = mss
+			}
+			a.incr += mss*mss/a.incr + mss/16
+			if (a.cwnd+1)*mss <= a.incr {
+				a.cwnd = (a.incr + mss - 1) / mss
+			}
+		}
+		if a.cwnd > a.rmtWnd {
+			a.cwnd = a.rmtWnd
+			a.incr = a.rmtWnd * mss
+		}
+	}
+	return nil
+}
+
+// wnd 返回接收窗口的剩余大小
+func (a *arq) wnd() uint16 {
+	if n := uint32(len(a.rcvQueue)); n < a.rcvWnd {
+		return uint16(a.rcvWnd - n)
+	}
+	return 0
+}
+
+func (a *arq) emit(h header, data []byte) {
+	if len(a.buf)+headerSize+len(data) > a.mtu {
+		a.output(a.buf)
+		a.buf = a.buf[:0]
+	}
+	a.buf = appendSegment(a.buf, h, data)
+}
+
+// flush 发送确认、窗口探测、新数据及需要重传的数据
+func (a *arq) flush(now uint32) {
+	h := header{conv: a.conv, wnd: a.wnd(), una: a.rcvNxt}
+
+	h.cmd = cmdAck
+	for _, ack := range a.acks {
+		h.sn, h.ts = ack.sn, ack.ts
+		a.emit(h, nil)
+	}
+	a.acks = a.acks[:0]
+
+	// 对端接收窗口为0时定期询问
+	if a.rmtWnd == 0 {
+		if a.probeWait == 0 {
+			a.probeWait = probeInit
+			a.tsProbe = now + a.probeWait
+		} else if diff(now, a.tsProbe) >= 0 {
+			a.probeWait = umin(a.probeWait+a.probeWait/2, probeLimit)
+			a.tsProbe = now + a.probeWait
+			a.probe |= askSend
+		}
+	} else {
+		a.probeWait = 0
+		a.tsProbe = 0
+	}
+	h.sn, h.ts = 0, now
+	if a.probe&askSend != 0 {
+		h.cmd = cmdWask
+		a.emit(h, nil)
+	}
+	if a.probe&askTell != 0 {
+		h.cmd = cmdWins
+		a.emit(h, nil)
+	}
+	a.probe = 0
+
+	cwnd := umin(a.sndWnd, a.rmtWnd)
+	if !a.noCongestion {
+		cwnd = umin(cwnd, a.cwnd)
+	}
+	for len(a.sndQueue) > 0 && diff(a.sndNxt, a.sndUna+cwnd) < 0 {
+		seg := a.sndQueue[0]
+		a.sndQueue[0] = nil
+		a.sndQueue = a.sndQueue[1:]
+		seg.sn = a.sndNxt
+		a.sndNxt++
+		a.sndBuf = append(a.sndBuf, seg)
+	}
+
+	lost, change := false, false
+	for _, seg := range a.sndBuf {
+		send := false
+		switch {
+		case seg.xmit == 0:
+			send = true
+			seg.rto = a.rto
+			seg.resendts = now + seg.rto
+		case diff(now, seg.resendts) >= 0:
+			send = true
+			seg.rto = umin(seg.rto+seg.rto/2, maxRTO)
+			seg.resendts = now + seg.rto
+			lost = true
+		case a.fastResend > 0 && seg.fastack >= a.fastResend:
+			send = true
+			seg.fastack = 0
+			seg.resendts = now + seg.rto
+			change = true
+		}
+		if !send {
+			continue
+		}
+
+		seg.xmit++
+		seg.ts = now
+		h.cmd, h.sn, h.ts = seg.cmd, seg.sn, seg.ts
+		a.emit(h, seg.data)
+		if seg.xmit >= deadLink {
+			a.dead = true
+		}
+	}
+	if len(a.buf) > 0 {
+		a.output(a.buf)
+		a.buf = a.buf[:0]
+	}
+
+	if change {
+		inflight := a.sndNxt - a.sndUna
+		a.ssthresh = umax(inflight/2, minSsthresh)
+		a.cwnd = a.ssthresh + a.fastResend
+		a.incr = a.cwnd * uint32(a.mss)
+	}
+	if lost {
+		a.ssthresh = umax(a.cwnd/2, minSsthresh)
+		a.cwnd = 1
+		a.incr = uint32(a.mss)
+	}
+}
+
+func umin(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func umax(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,185 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+// maxDatagramSize UDP数据报的最大长度
+const maxDatagramSize = 65535
+
+// acceptBacklog 等待accept的Session的数量, 超过时丢弃来自新地址的数据报
+const acceptBacklog = 128
+
+var errListenerClosed = errors.New("rudp: listener closed")
+
+// Listener 在一个UDP socket上为每个远端地址创建Session, 实现了net.Listener,
+// 可以直接用于rapidnet.TCPServer.Serve.
+// 收到来自新地址的数据时创建Session, 对端确认收到Session发送的数据之前使用Options.HandshakeTimeout作为空闲超时时间.
+// Close后不再创建新的Session, 已建立的Session不受影响,
+// 所有Session结束后关闭socket.
+type Listener struct {
+	pc   net.PacketConn
+	opts *Options
+
+	sessionChan chan *Session
+	closeChan   chan struct{}
+
+	mutex    sync.Mutex
+	sessions map[string]*Session
+	closed   bool
+}
+
+// Listen 在address上监听UDP
+func Listen(address string, opts *Options) (*Listener, error) {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return Serve(pc, opts), nil
+}
+
+// Serve 在已有的socket上接收数据报, 可用于非UDP的数据报传输层, 例如测试使用的Network
+func Serve(pc net.PacketConn, opts *Options) *Listener {
+	l := &Listener{
+		pc:          pc,
+		opts:        opts,
+		sessionChan: make(chan *Session, acceptBacklog),
+		closeChan:   make(chan struct{}),
+		sessions:    make(map[string]*Session),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *Listener) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			l.Close()
+			for _, s := range l.list() {
+				s.terminate(err)
+			}
+			return
+		}
+
+		l.deliver(addr, buf[:n])
+	}
+}
+
+// deliver 将数据报交给addr对应的Session, 不存在并且data是新连接的数据时创建新的Session,
+// 处理数据报后再等待accept, 拒绝连接时已收到的字节数是确定的. 已关闭或等待accept的Session过多时丢弃数据报
+func (l *Listener) deliver(addr net.Addr, data []byte) {
+	key := addr.String()
+
+	l.mutex.Lock()
+	if s, ok := l.sessions[key]; ok {
+		l.mutex.Unlock()
+		s.input(data)
+		return
+	}
+	defer l.mutex.Unlock()
+
+	// 只有数据可以创建Session, 忽略已结束的Session的确认及关闭
+	if l.closed || len(data) < headerSize || data[4] != cmdPush {
+		return
+	}
+	// 只有读取循环放入sessionChan, 检查后不会阻塞
+	if len(l.sessionChan) == cap(l.sessionChan) {
+		return
+	}
+
+	var s *Session
+	s = newSession(l.pc, addr, binary.LittleEndian.Uint32(data), false, l.opts, func() { l.remove(key, s) })
+	s.input(data)
+	l.sessions[key] = s
+	l.sessionChan <- s
+}
+
+// remove 删除已结束的Session, 不再创建新的Session并且所有Session都已结束时关闭socket
+func (l *Listener) remove(key string, s *Session) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.sessions[key] == s {
+		delete(l.sessions, key)
+	}
+	if l.closed && len(l.sessions) == 0 {
+		l.pc.Close()
+	}
+}
+
+func (l *Listener) list() []*Session {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	list := make([]*Session, 0, len(l.sessions))
+	for _, s := range l.sessions {
+		list = append(list, s)
+	}
+	return list
+}
+
+// Accept 返回下一个新的Session
+func (l *Listener) Accept() (net.Conn, error) {
+	s, err := l.AcceptSession()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// AcceptSession 返回下一个新的Session, 跳过等待期间已结束的Session
+func (l *Listener) AcceptSession() (*Session, error) {
+	for {
+		select {
+		case s := <-l.sessionChan:
+			select {
+			case <-s.closeChan:
+				continue
+			default:
+			}
+			return s, nil
+		case <-l.closeChan:
+			return nil, errListenerClosed
+		}
+	}
+}
+
+// Close 不再创建新的Session, 已建立的Session不受影响. 所有Session结束后关闭socket
+func (l *Listener) Close() error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.closeChan)
+	l.mutex.Unlock()
+
+	// 结束还没有accept的Session
+	for {
+		select {
+		case s := <-l.sessionChan:
+			s.terminate(errListenerClosed)
+		default:
+			l.mutex.Lock()
+			if len(l.sessions) == 0 {
+				l.pc.Close()
+			}
+			l.mutex.Unlock()
+			return nil
+		}
+	}
+}
+
+// Addr 返回监听的地址
+func (l *Listener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
@@ -0,0 +1,147 @@
+package rudp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memQueueSize 每个PacketConn缓存的未读取的数据报数量, 超过时丢弃
+const memQueueSize = 1024
+
+var errNetworkClosed = errors.New("rudp: use of closed network connection")
+
+// Network 内存中的不可靠数据报网络, 用于在本地测试丢包、延迟及乱序
+type Network struct {
+	mutex    sync.Mutex
+	loss     float64
+	latency  time.Duration
+	jitter   time.Duration
+	rand     *rand.Rand
+	conns    map[string]*memConn
+	lastPort int
+}
+
+// NewNetwork 创建内存网络. loss为丢包率(0到1之间), 每个数据报的延迟在latency到latency+jitter之间,
+// jitter会导致乱序. seed用于生成丢包及延迟, 相同的seed产生相同的随机序列
+func NewNetwork(loss float64, latency, jitter time.Duration, seed int64) *Network {
+	return &Network{
+		loss:    loss,
+		latency: latency,
+		jitter:  jitter,
+		rand:    rand.New(rand.NewSource(seed)),
+		conns:   make(map[string]*memConn),
+	}
+}
+
+// SetLoss 修改丢包率, 为1时所有数据报都被丢弃, 可用于模拟网络中断
+func (n *Network) SetLoss(loss float64) {
+	n.mutex.Lock()
+	n.loss = loss
+	n.mutex.Unlock()
+}
+
+// ListenPacket 创建一个使用新地址的PacketConn
+func (n *Network) ListenPacket() net.PacketConn {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.lastPort++
+	c := &memConn{
+		network:   n,
+		addr:      memAddr("mem:" + strconv.Itoa(n.lastPort)),
+		dataChan:  make(chan memPacket, memQueueSize),
+		closeChan: make(chan struct{}),
+	}
+	n.conns[c.addr.String()] = c
+	return c
+}
+
+// deliver 按照丢包率及延迟将数据报发送到addr
+func (n *Network) deliver(from, to net.Addr, data []byte) {
+	n.mutex.Lock()
+	c := n.conns[to.String()]
+	drop := n.rand.Float64() < n.loss
+	delay := n.latency
+	if n.jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(n.jitter)))
+	}
+	n.mutex.Unlock()
+
+	if c == nil || drop {
+		return
+	}
+	p := memPacket{from: from, data: append([]byte(nil), data...)}
+	if delay <= 0 {
+		c.push(p)
+		return
+	}
+	time.AfterFunc(delay, func() { c.push(p) })
+}
+
+func (n *Network) remove(c *memConn) {
+	n.mutex.Lock()
+	delete(n.conns, c.addr.String())
+	n.mutex.Unlock()
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memPacket struct {
+	from net.Addr
+	data []byte
+}
+
+// memConn Network中的一个端点, 实现了net.PacketConn, 不支持超时
+type memConn struct {
+	network   *Network
+	addr      memAddr
+	dataChan  chan memPacket
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *memConn) push(p memPacket) {
+	select {
+	case c.dataChan <- p:
+	default:
+	}
+}
+
+func (c *memConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.dataChan:
+		return copy(b, p.data), p.from, nil
+	case <-c.closeChan:
+		return 0, nil, errNetworkClosed
+	}
+}
+
+func (c *memConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closeChan:
+		return 0, errNetworkClosed
+	default:
+	}
+	c.network.deliver(c.addr, addr, b)
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+		c.network.remove(c)
+	})
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr                { return c.addr }
+func (c *memConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
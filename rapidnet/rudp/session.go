@@ -0,0 +1,465 @@
+package rudp
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lzhig/rapidgo/rapidnet"
+)
+
+// Options 可靠UDP的参数, 为nil或字段为0时使用默认值. 通信双方的MTU应该相同
+type Options struct {
+	// MTU 每个数据报的最大长度, 默认为1400
+	MTU int
+
+	// SendWindow 发送窗口的segment数量, 默认为128
+	SendWindow int
+
+	// ReceiveWindow 接收窗口的segment数量, 默认为128
+	ReceiveWindow int
+
+	// Interval 检查重传的间隔, 默认为10ms
+	Interval time.Duration
+
+	// MinRTO 最小的重传超时时间, 默认为30ms
+	MinRTO time.Duration
+
+	// FastResend 被后面的segment的确认跳过此次数后立即重传, 默认为2, 小于0时不启用快速重传
+	FastResend int
+
+	// NoCongestion 为true时不启用拥塞控制, 只受发送窗口及对端接收窗口限制
+	NoCongestion bool
+
+	// IdleTimeout 超过此时间没有收到数据报时以rapidnet.ErrIdleTimeout关闭, 默认为60s
+	IdleTimeout time.Duration
+
+	// HandshakeTimeout Listener创建的Session在对端确认收到Session发送的数据之前使用的空闲超时时间, 默认为5s,
+	// 大于IdleTimeout时使用IdleTimeout. 任何数据都可以创建Session, 来源地址可能是伪造的,
+	// 这样的Session不会被确认, 很快被清理
+	HandshakeTimeout time.Duration
+}
+
+const (
+	defaultMTU         = 1400
+	defaultWindow      = 128
+	defaultInterval    = 10 * time.Millisecond
+	defaultMinRTO      = 30 * time.Millisecond
+	defaultFastResend  = 2
+	defaultIdleTimeout = 60 * time.Second
+
+	defaultHandshakeTimeout = 5 * time.Second
+
+	// closeTimeout Close后等待未确认的数据被确认的最长时间
+	closeTimeout = 10 * time.Second
+)
+
+func (opts *Options) mtu() int {
+	if opts != nil && opts.MTU > headerSize {
+		return opts.MTU
+	}
+	return defaultMTU
+}
+
+func (opts *Options) sendWindow() uint32 {
+	if opts != nil && opts.SendWindow > 0 {
+		return uint32(opts.SendWindow)
+	}
+	return defaultWindow
+}
+
+func (opts *Options) receiveWindow() uint32 {
+	if opts != nil && opts.ReceiveWindow > 0 {
+		return uint32(opts.ReceiveWindow)
+	}
+	return defaultWindow
+}
+
+func (opts *Options) interval() uint32 {
+	if opts != nil && opts.Interval > 0 {
+		return uint32(opts.Interval / time.Millisecond)
+	}
+	return uint32(defaultInterval / time.Millisecond)
+}
+
+func (opts *Options) minRTO() uint32 {
+	if opts != nil && opts.MinRTO > 0 {
+		return uint32(opts.MinRTO / time.Millisecond)
+	}
+	return uint32(defaultMinRTO / time.Millisecond)
+}
+
+func (opts *Options) fastResend() uint32 {
+	if opts == nil || opts.FastResend == 0 {
+		return defaultFastResend
+	}
+	if opts.FastResend < 0 {
+		return 0
+	}
+	return uint32(opts.FastResend)
+}
+
+func (opts *Options) idleTimeout() time.Duration {
+	if opts != nil && opts.IdleTimeout > 0 {
+		return opts.IdleTimeout
+	}
+	return defaultIdleTimeout
+}
+
+func (opts *Options) handshakeTimeout() time.Duration {
+	d := defaultHandshakeTimeout
+	if opts != nil && opts.HandshakeTimeout > 0 {
+		d = opts.HandshakeTimeout
+	}
+	if idle := opts.idleTimeout(); d > idle {
+		d = idle
+	}
+	return d
+}
+
+var (
+	// ErrDeadLink 数据多次重传仍未被确认, 对端可能已不可达
+	ErrDeadLink = errors.New("rudp: dead link")
+
+	errClosed = errors.New("rudp: session closed")
+)
+
+// timeoutError 读写超时, 实现了net.Error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "rudp: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Session 基于UDP的可靠、有序的字节流, 实现了net.Conn.
+// 使用KCP风格的选择重传、快速重传及拥塞控制, 在丢包的网络上比TCP的延迟更低,
+// 可以作为rapidnet.TCPServer.Serve的listener(参见Listener)或rapidnet.TCPClient.ConnectConn的连接,
+// 使用任意的PacketHandlerFactory封包.
+// Close后在后台继续发送未确认的数据及关闭通知, 对端读取完所有数据后Read返回io.EOF
+type Session struct {
+	pc   net.PacketConn
+	addr net.Addr
+	opts *Options
+
+	start time.Time
+
+	mutex         sync.Mutex
+	arq           *arq
+	lastReceive   time.Time
+	confirmed     bool  // 对端已确认收到发送的数据, 或Session由本端建立
+	received      int   // 收到的字节数
+	writeLimited  bool  // 为true时输出的数据报受writeBudget限制
+	writeBudget   int   // LimitWrites后还可以输出的字节数
+	closing       bool  // 已调用Close, 不能再读写
+	readErr       error // 不为nil时读取完已收到的数据后返回
+	writeErr      error
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+	closeChan  chan struct{} // 结束时关闭, 不再收发数据报
+	closeOnce  sync.Once
+	onClose    func()
+}
+
+func newSession(pc net.PacketConn, addr net.Addr, conv uint32, confirmed bool, opts *Options, onClose func()) *Session {
+	s := &Session{
+		pc:          pc,
+		addr:        addr,
+		opts:        opts,
+		start:       time.Now(),
+		lastReceive: time.Now(),
+		confirmed:   confirmed,
+		readEvent:   make(chan struct{}, 1),
+		writeEvent:  make(chan struct{}, 1),
+		closeChan:   make(chan struct{}),
+		onClose:     onClose,
+	}
+	s.arq = newARQ(conv, opts, s.output)
+	go s.update()
+	return s
+}
+
+// Dial 创建连接到address的Session, 不会与服务器交互
+func Dial(address string, opts *Options) (*Session, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return NewSession(pc, addr, opts), nil
+}
+
+// NewSession 使用pc创建连接到addr的Session, pc只用于此Session, Session结束时关闭.
+// 可用于非UDP的数据报传输层, 例如测试使用的Network
+func NewSession(pc net.PacketConn, addr net.Addr, opts *Options) *Session {
+	s := newSession(pc, addr, rand.Uint32(), true, opts, func() { pc.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				s.terminate(err)
+				return
+			}
+			if from.String() == addr.String() {
+				s.input(buf[:n])
+			}
+		}
+	}()
+	return s
+}
+
+func (s *Session) now() uint32 {
+	return uint32(time.Since(s.start) / time.Millisecond)
+}
+
+// output 发送一个数据报, 由arq在持有锁时调用. LimitWrites后超过剩余字节数的数据报被丢弃
+func (s *Session) output(b []byte) {
+	if s.writeLimited {
+		if len(b) > s.writeBudget {
+			return
+		}
+		s.writeBudget -= len(b)
+	}
+	s.pc.WriteTo(b, s.addr)
+}
+
+// update 定期发送需要重传的数据, 检查空闲超时及Close后的关闭
+func (s *Session) update() {
+	ticker := time.NewTicker(time.Duration(s.arq.interval) * time.Millisecond)
+	defer ticker.Stop()
+
+	idleTimeout := s.opts.idleTimeout()
+	handshakeTimeout := s.opts.handshakeTimeout()
+	var closeDeadline time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closeChan:
+			return
+		}
+
+		s.mutex.Lock()
+		s.arq.flush(s.now())
+		var err error
+		switch {
+		case s.arq.dead:
+			err = ErrDeadLink
+		case time.Since(s.lastReceive) > idleTimeout,
+			!s.confirmed && time.Since(s.lastReceive) > handshakeTimeout:
+			err = rapidnet.ErrIdleTimeout
+		case s.closing:
+			if closeDeadline.IsZero() {
+				closeDeadline = time.Now().Add(closeTimeout)
+			}
+			if s.arq.waitSnd() == 0 || time.Now().After(closeDeadline) {
+				err = errClosed
+			}
+		}
+		s.mutex.Unlock()
+
+		if err != nil {
+			s.terminate(err)
+			return
+		}
+	}
+}
+
+// input 处理收到的数据报
+func (s *Session) input(data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.arq.input(data, s.now()); err != nil {
+		return
+	}
+	s.lastReceive = time.Now()
+	s.received += len(data)
+	// 发送的序号从0开始, sndUna不为0说明对端收到了发送的数据
+	if s.arq.sndUna != 0 {
+		s.confirmed = true
+	}
+	if s.arq.readable() {
+		notify(s.readEvent)
+	}
+	if s.arq.waitSnd() < int(s.arq.sndWnd) {
+		notify(s.writeEvent)
+	}
+	s.arq.flush(s.now())
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// terminate 结束Session, 不再收发数据报
+func (s *Session) terminate(err error) {
+	s.closeOnce.Do(func() {
+		s.mutex.Lock()
+		if s.readErr == nil {
+			s.readErr = err
+		}
+		if s.writeErr == nil {
+			s.writeErr = err
+		}
+		s.mutex.Unlock()
+
+		close(s.closeChan)
+		if s.onClose != nil {
+			s.onClose()
+		}
+	})
+}
+
+// wait 等待ch或deadline, 超时返回false
+func (s *Session) wait(ch chan struct{}, deadline time.Time) bool {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return false
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+	case <-s.closeChan:
+	case <-timeout:
+		return false
+	}
+	return true
+}
+
+func (s *Session) Read(b []byte) (int, error) {
+	for {
+		s.mutex.Lock()
+		if s.closing {
+			s.mutex.Unlock()
+			return 0, errClosed
+		}
+		if n := s.arq.recv(b); n > 0 {
+			if s.arq.probe != 0 {
+				s.arq.flush(s.now())
+			}
+			if s.arq.readable() {
+				notify(s.readEvent)
+			}
+			s.mutex.Unlock()
+			return n, nil
+		}
+		if s.arq.eof {
+			s.mutex.Unlock()
+			return 0, io.EOF
+		}
+		if err := s.readErr; err != nil {
+			s.mutex.Unlock()
+			return 0, err
+		}
+		deadline := s.readDeadline
+		s.mutex.Unlock()
+
+		if !s.wait(s.readEvent, deadline) {
+			return 0, timeoutError{}
+		}
+	}
+}
+
+// Write 将b放入发送队列并立即发送窗口内的数据.
+// 未确认的数据超过发送窗口的两倍时等待
+func (s *Session) Write(b []byte) (int, error) {
+	for {
+		s.mutex.Lock()
+		if err := s.writeErr; err != nil {
+			s.mutex.Unlock()
+			return 0, err
+		}
+		if s.arq.waitSnd() < 2*int(s.arq.sndWnd) {
+			s.arq.send(b)
+			s.arq.flush(s.now())
+			s.mutex.Unlock()
+			return len(b), nil
+		}
+		deadline := s.writeDeadline
+		s.mutex.Unlock()
+
+		if !s.wait(s.writeEvent, deadline) {
+			return 0, timeoutError{}
+		}
+	}
+}
+
+// Close 不能再读写. 已写入的数据及关闭通知在后台继续发送, 全部被确认(最多等待10秒)后Session结束
+func (s *Session) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closing {
+		return nil
+	}
+	s.closing = true
+	s.arq.sendFin()
+	s.arq.flush(s.now())
+	if s.writeErr == nil {
+		s.writeErr = errClosed
+	}
+	notify(s.readEvent)
+	notify(s.writeEvent)
+	return nil
+}
+
+// LimitWrites 实现rapidnet.AmplificationLimiter, 之后输出的数据报(包括重传及确认)的总字节数不能超过已收到的字节数.
+// 服务器拒绝连接时调用, 避免向伪造的源地址反复重传拒绝数据包
+func (s *Session) LimitWrites() {
+	s.mutex.Lock()
+	s.writeLimited = true
+	s.writeBudget = s.received
+	s.mutex.Unlock()
+}
+
+// LocalAddr function
+func (s *Session) LocalAddr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// RemoteAddr function
+func (s *Session) RemoteAddr() net.Addr {
+	return s.addr
+}
+
+// SetDeadline function
+func (s *Session) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline function
+func (s *Session) SetReadDeadline(t time.Time) error {
+	s.mutex.Lock()
+	s.readDeadline = t
+	s.mutex.Unlock()
+	notify(s.readEvent)
+	return nil
+}
+
+// SetWriteDeadline function
+func (s *Session) SetWriteDeadline(t time.Time) error {
+	s.mutex.Lock()
+	s.writeDeadline = t
+	s.mutex.Unlock()
+	notify(s.writeEvent)
+	return nil
+}
@@ -0,0 +1,212 @@
+package rudp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/lzhig/rapidgo/rapidnet"
+)
+
+func TestSession_Lossy(t *testing.T) {
+	network := NewNetwork(0.2, 20*time.Millisecond, 10*time.Millisecond, 1)
+	l := Serve(network.ListenPacket(), nil)
+	defer l.Close()
+
+	data := make([]byte, 100*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	client := NewSession(network.ListenPacket(), l.Addr(), nil)
+	go func() {
+		for b := data; len(b) > 0; b = b[1000:] {
+			if len(b) < 1000 {
+				client.Write(b)
+				break
+			}
+			client.Write(b[:1000])
+		}
+		client.Close()
+	}()
+
+	s, err := l.AcceptSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 客户端Close后数据全部确认才通知关闭, ReadAll读到io.EOF时返回
+	s.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes, want %d bytes", len(got), len(data))
+	}
+}
+
+func TestSession_IdleTimeout(t *testing.T) {
+	network := NewNetwork(0, time.Millisecond, 0, 1)
+	opts := &Options{IdleTimeout: 200 * time.Millisecond}
+	l := Serve(network.ListenPacket(), opts)
+	defer l.Close()
+
+	client := NewSession(network.ListenPacket(), l.Addr(), opts)
+	defer client.Close()
+	client.Write([]byte("hello"))
+
+	s, err := l.AcceptSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, err := s.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("got %q %v, want %q", buf[:n], err, "hello")
+	}
+
+	network.SetLoss(1)
+	if _, err := s.Read(buf); err != rapidnet.ErrIdleTimeout {
+		t.Fatal("expect ErrIdleTimeout, got", err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	network := NewNetwork(0.1, 10*time.Millisecond, 5*time.Millisecond, 1)
+	l := Serve(network.ListenPacket(), nil)
+
+	const count = 100
+	cfg := &rapidnet.Config{SendQueueSize: count}
+	server := rapidnet.CreateTCPServerWithConfig(cfg)
+	serverEvents, err := server.Serve(l, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := rapidnet.CreateTCPClientWithConfig(cfg)
+	conn, clientEvents, err := client.ConnectConn(NewSession(network.ListenPacket(), l.Addr(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		if err := conn.Send([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	event := <-serverEvents
+	if event.Type != rapidnet.EventConnected {
+		t.Fatal("expect EventConnected, got", event.Type)
+	}
+	serverConn := event.Conn
+	for i := 0; i < count; i++ {
+		data := <-serverConn.ReceiveDataChan()
+		if want := fmt.Sprint(i); string(data) != want {
+			t.Fatalf("got %q, want %q", data, want)
+		}
+		serverConn.Send(data)
+	}
+	for i := 0; i < count; i++ {
+		if data, want := <-conn.ReceiveDataChan(), fmt.Sprint(i); string(data) != want {
+			t.Fatalf("got %q, want %q", data, want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go server.Shutdown(ctx)
+
+	for event := range clientEvents {
+		if event.Type == rapidnet.EventDisconnected {
+			break
+		}
+	}
+	event = <-serverEvents
+	if event.Type != rapidnet.EventDisconnected {
+		t.Fatal("expect EventDisconnected, got", event.Type)
+	}
+}
+
+func TestListener_HandshakeTimeout(t *testing.T) {
+	network := NewNetwork(0, time.Millisecond, 0, 1)
+	opts := &Options{IdleTimeout: 10 * time.Second, HandshakeTimeout: 100 * time.Millisecond}
+	l := Serve(network.ListenPacket(), opts)
+	defer l.Close()
+
+	// 伪造来源地址的数据不会确认服务器发送的数据, Session很快被清理
+	spoofed := network.ListenPacket()
+	defer spoofed.Close()
+	spoofed.WriteTo(appendSegment(nil, header{conv: 1, cmd: cmdPush}, []byte("hello")), l.Addr())
+	s, err := l.AcceptSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if n, err := s.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("got %q %v, want %q", buf[:n], err, "hello")
+	}
+	s.Write([]byte("world"))
+	if _, err := s.Read(buf); err != rapidnet.ErrIdleTimeout {
+		t.Fatal("expect ErrIdleTimeout, got", err)
+	}
+
+	client := NewSession(network.ListenPacket(), l.Addr(), opts)
+	defer client.Close()
+	client.Write([]byte("hello"))
+	s, err = l.AcceptSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n, err := s.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("got %q %v, want %q", buf[:n], err, "hello")
+	}
+	s.Write([]byte("world"))
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "world" {
+		t.Fatalf("got %q %v, want %q", buf[:n], err, "world")
+	}
+
+	// 对端确认后使用IdleTimeout
+	s.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := s.Read(buf); err != (timeoutError{}) {
+		t.Fatal("expect timeout, got", err)
+	}
+}
+
+func TestSession_LimitWrites(t *testing.T) {
+	network := NewNetwork(0, time.Millisecond, 0, 1)
+	l := Serve(network.ListenPacket(), nil)
+	defer l.Close()
+
+	spoofed := network.ListenPacket()
+	defer spoofed.Close()
+	spoofed.WriteTo(appendSegment(nil, header{conv: 1, cmd: cmdPush}, []byte("hello")), l.Addr())
+	s, err := l.AcceptSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 收到的确认在LimitWrites之前发送
+	buf := make([]byte, maxDatagramSize)
+	if _, _, err := spoofed.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// 写入的数据比收到的数据报大, 包括重传在内都不发送
+	s.LimitWrites()
+	s.Write(make([]byte, 100))
+	received := make(chan int, 1)
+	go func() {
+		n, _, _ := spoofed.ReadFrom(buf)
+		received <- n
+	}()
+	select {
+	case n := <-received:
+		t.Fatalf("unexpected datagram of %d bytes", n)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
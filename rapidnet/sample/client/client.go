@@ -1,108 +1,16 @@
 package main
 
 import (
-	"bufio"
-	"errors"
+	"encoding/binary"
 	"flag"
 	"fmt"
-	"io"
-	"net"
 	"runtime"
-	"time"
 
 	"github.com/lzhig/rapidgo/rapidnet"
 )
 
-const (
-	defaultTag        = 0xDCFE
-	defaultTagSize    = 2 // 2bytes
-	defaultLenSize    = 4 //2 bytes
-	defaultHeaderSize = defaultTagSize + defaultLenSize
-)
-
-type packetHandler struct {
-	conn      net.Conn
-	bufReader *bufio.Reader
-	bufWriter *bufio.Writer
-
-	data        []byte
-	dataLen     int
-	readed      int
-	headerReady bool
-}
-
-func (obj *packetHandler) Receive() ([]byte, error) {
-	if !obj.headerReady {
-		// 读取header
-		obj.conn.SetReadDeadline(time.Now().Add(time.Second * 2))
-		p, err := obj.bufReader.Peek(defaultHeaderSize)
-		if err == io.EOF {
-			return nil, err
-		}
-		if err == nil && len(p) == defaultHeaderSize {
-			if p[0] != 0xFE || p[1] != 0xDC {
-				return nil, errors.New("invalid data")
-			}
-
-			obj.bufReader.Discard(defaultHeaderSize)
-			obj.headerReady = true
-
-			obj.dataLen = (int(p[5]) << 24) + (int(p[4]) << 16) + (int(p[3]) << 8) + int(p[2])
-			obj.data = make([]byte, obj.dataLen)
-		} else {
-			nerr, ok := err.(net.Error)
-			if ok {
-				if nerr.Timeout() {
-					return nil, nil
-				} else if nerr.Temporary() {
-					return nil, nerr
-				}
-			}
-		}
-	}
-
-	// read body
-
-	obj.conn.SetReadDeadline(time.Now().Add(time.Second * 2))
-	n, err := obj.bufReader.Read(obj.data[obj.readed:])
-	if err == nil {
-		obj.readed += n
-		if obj.readed == obj.dataLen {
-			p := obj.data
-			obj.data = nil
-			obj.readed = 0
-			obj.headerReady = false
-			obj.dataLen = 0
-			return p, nil
-		}
-	} else if err == io.EOF {
-		return nil, err
-	}
-
-	return nil, nil
-}
-
-func (obj *packetHandler) Send(data []byte) error {
-	len := len(data)
-
-	if len > 0x7FFFFFFF {
-		return errors.New("too large")
-	}
-
-	n, err := obj.bufWriter.Write([]byte{0xFE, 0xDC, byte(len & 0xFF), byte((len & 0xFF00) >> 8), byte((len & 0xFF0000) >> 16), byte((len & 0xFF000000) >> 24)})
-	if n != defaultHeaderSize || err != nil {
-		obj.conn.Close()
-		return err
-	}
-
-	n, err = obj.bufWriter.Write(data)
-	if n != len || err != nil {
-		obj.conn.Close()
-		return err
-	}
-
-	return nil
-}
+// 0xFEDC标记, 4字节小端长度
+var packetSpec = rapidnet.LengthFieldSpec{Tag: []byte{0xFE, 0xDC}, LengthSize: 4, ByteOrder: binary.LittleEndian, MaxFrameSize: 0x7FFFFFFF}
 
 func main() {
 	var ip = flag.String("address", "192.168.2.50:8010", "help message for flagname")
@@ -110,14 +18,7 @@ func main() {
 	flag.Parse()
 	runtime.GOMAXPROCS(4)
 
-	// config := &rapidnet.Config{PacketHandlerFactory: func(c net.Conn) rapidnet.PacketHandler {
-	// 	return &packetHandler{
-	// 		conn:      c,
-	// 		bufReader: bufio.NewReader(c),
-	// 		bufWriter: bufio.NewWriter(c),
-	// 	}
-	// },
-	// }
+	// config := &rapidnet.Config{PacketHandlerFactory: rapidnet.NewLengthFieldPacketHandlerFactory(packetSpec)}
 	// rapidnet.Init(config)
 
 	for i := 0; i < *num; i++ {
@@ -1,115 +1,39 @@
 package main
 
 import (
-	"bufio"
-	"errors"
+	"encoding/binary"
 	"flag"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"runtime"
-	"time"
 
 	_ "net/http/pprof"
 
-	"net"
-
 	"github.com/lzhig/rapidgo/rapidnet"
 )
 
-const (
-	defaultTag        = 0xDCFE
-	defaultTagSize    = 2 // 2bytes
-	defaultLenSize    = 4 //2 bytes
-	defaultHeaderSize = defaultTagSize + defaultLenSize
-)
+// 0xFEDC标记, 4字节小端长度
+var packetSpec = rapidnet.LengthFieldSpec{Tag: []byte{0xFE, 0xDC}, LengthSize: 4, ByteOrder: binary.LittleEndian, MaxFrameSize: 0x7FFFFFFF}
 
-type packetHandler struct {
-	conn      net.Conn
-	bufReader *bufio.Reader
-	bufWriter *bufio.Writer
+type serverHandler struct{}
 
-	data        []byte
-	dataLen     int
-	readed      int
-	headerReady bool
+func (h *serverHandler) OnConnected(conn *rapidnet.Connection) {
+	fmt.Println(conn.RemoteAddr().String(), "connected")
 }
 
-func (obj *packetHandler) Receive() ([]byte, error) {
-	if !obj.headerReady {
-		// 读取header
-		obj.conn.SetReadDeadline(time.Now().Add(time.Second * 2))
-		p, err := obj.bufReader.Peek(defaultHeaderSize)
-		if err == io.EOF {
-			return nil, err
-		}
-		if err == nil && len(p) == defaultHeaderSize {
-			if p[0] != 0xFE || p[1] != 0xDC {
-				return nil, errors.New("invalid data")
-			}
-
-			obj.bufReader.Discard(defaultHeaderSize)
-			obj.headerReady = true
-
-			obj.dataLen = (int(p[5]) << 24) + (int(p[4]) << 16) + (int(p[3]) << 8) + int(p[2])
-			obj.data = make([]byte, obj.dataLen)
-		} else {
-			nerr, ok := err.(net.Error)
-			if ok {
-				if nerr.Timeout() {
-					return nil, nil
-				} else if nerr.Temporary() {
-					return nil, nerr
-				}
-			}
-		}
-	}
-
-	// read body
-
-	obj.conn.SetReadDeadline(time.Now().Add(time.Second * 2))
-	n, err := obj.bufReader.Read(obj.data[obj.readed:])
-	if err == nil {
-		obj.readed += n
-		if obj.readed == obj.dataLen {
-			p := obj.data
-			obj.data = nil
-			obj.readed = 0
-			obj.headerReady = false
-			obj.dataLen = 0
-			return p, nil
-		}
-	} else if err == io.EOF {
-		return nil, err
-	}
-
-	return nil, nil
+func (h *serverHandler) OnPacket(conn *rapidnet.Connection, data []byte) {
+	fmt.Println("Recieve data. size:", len(data))
+	conn.Send(data)
 }
 
-func (obj *packetHandler) Send(data []byte) error {
-	len := len(data)
-
-	if len > 0x7FFFFFFF {
-		return errors.New("too large")
-	}
-
-	n, err := obj.bufWriter.Write([]byte{0xFE, 0xDC, byte(len & 0xFF), byte((len & 0xFF00) >> 8), byte((len & 0xFF0000) >> 16), byte((len & 0xFF000000) >> 24)})
-	if n != defaultHeaderSize || err != nil {
-		obj.conn.Close()
-		return err
-	}
-
-	n, err = obj.bufWriter.Write(data)
-	if n != len || err != nil {
-		obj.conn.Close()
-		return err
-	}
-
-	return nil
+func (h *serverHandler) OnDisconnected(conn *rapidnet.Connection, err error) {
+	fmt.Println(conn.RemoteAddr().String(), "disconnected", err)
 }
 
-var server = rapidnet.CreateTCPServer()
+func (h *serverHandler) OnSendFailed(conn *rapidnet.Connection, err error) {
+	fmt.Println(conn.RemoteAddr().String(), "Failed to send", err)
+}
 
 func main() {
 	runtime.GOMAXPROCS(4)
@@ -117,53 +41,18 @@ func main() {
 		http.ListenAndServe("0.0.0.0:8092", nil)
 	}()
 
-	config := &rapidnet.Config{PacketHandlerFactory: func(c net.Conn) rapidnet.PacketHandler {
-		return &packetHandler{
-			conn:      c,
-			bufReader: bufio.NewReader(c),
-			bufWriter: bufio.NewWriter(c),
-		}
-	},
-	}
-	rapidnet.Init(config)
+	config := &rapidnet.Config{PacketHandlerFactory: rapidnet.NewLengthFieldPacketHandlerFactory(packetSpec)}
+	server := rapidnet.CreateTCPServerWithConfig(config)
 
 	var ip = flag.String("address", "0.0.0.0:8888", "help message for flagname")
 	var num = flag.Int("num", 10000, "connections")
 	flag.Parse()
 	fmt.Println("start server - ", *ip)
-	eventChan, err := server.Start(*ip, uint32(*num))
-	if err != nil {
+	if err := server.StartWithHandler(*ip, uint32(*num), &serverHandler{}); err != nil {
 		fmt.Println("result: ", err)
 		os.Exit(1)
 	}
 	fmt.Println("started.")
 
-	for {
-		select {
-		case event := <-eventChan:
-			switch event.Type {
-			case rapidnet.EventConnected:
-				fmt.Println(event.Conn.RemoteAddr().String(), "connected")
-				go handleConnection(event.Conn)
-			case rapidnet.EventDisconnected:
-				fmt.Println(event.Conn.RemoteAddr().String(), "disconnected", event.Err)
-
-			case rapidnet.EventSendFailed:
-				fmt.Println(event.Conn.RemoteAddr().String(), "Failed to send", event.Err)
-			}
-		}
-	}
-}
-
-func handleConnection(conn *rapidnet.Connection) {
-	for {
-		select {
-		case data := <-conn.ReceiveDataChan():
-			if data == nil {
-				return
-			}
-			fmt.Println("Recieve data. size:", len(data))
-			conn.Send(data)
-		}
-	}
+	select {}
 }
@@ -0,0 +1,304 @@
+package rapidnet
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// packetSizeBuckets 数据包大小直方图的上界(字节)
+var packetSizeBuckets = []int{64, 256, 1024, 4096, 16384, 65536}
+
+// ConnectionStats 连接的统计数据. 字节数为数据包的长度, 不包括封包格式的包头
+type ConnectionStats struct {
+	ConnectedAt    time.Time
+	BytesIn        uint64
+	BytesOut       uint64
+	PacketsIn      uint64
+	PacketsOut     uint64
+	SendDropped    uint64 // 发送队列已满而丢弃的数据包数量
+	ReceiveDropped uint64 // 收到数据的速率超过限制而丢弃的数据包数量
+}
+
+// Histogram 数据包大小的直方图, Buckets[i]为大小不超过64, 256, 1K, 4K, 16K, 64K字节的累计数量,
+// 最后一个元素为全部的数量
+type Histogram struct {
+	Buckets []uint64
+	Sum     uint64
+	Count   uint64
+}
+
+// ServerStats 服务器的统计数据
+type ServerStats struct {
+	ActiveConnections int64
+	Accepted          uint64            // 建立的连接数量, 不包括被拒绝的连接
+	Rejected          map[string]uint64 // 按原因统计拒绝的连接数量
+	Disconnects       map[string]uint64 // 按原因统计断开的连接数量
+	BytesIn           uint64
+	BytesOut          uint64
+	PacketsIn         uint64
+	PacketsOut        uint64
+	SendDropped       uint64
+	ReceiveDropped    uint64
+	PacketSizeIn      Histogram
+	PacketSizeOut     Histogram
+}
+
+// 断开原因, 用于统计
+var disconnectReasons = map[error]string{
+	io.EOF:           "eof",
+	errStopped:       "disconnect",
+	ErrServerClosed:  "shutdown",
+	ErrIdleTimeout:   "idle_timeout",
+	ErrSlowConsumer:  "slow_consumer",
+	ErrInvalidTag:    "protocol",
+	ErrFrameTooLarge: "protocol",
+	ErrInvalidLength: "protocol",
+	ErrChecksum:      "protocol",
+
+	ErrRateLimited:    "rate_limited",
+	ErrPacketTooLarge: "packet_too_large",
+	ErrHandedOff:      "handoff",
+	ErrHandoffTimeout: "handoff",
+}
+
+// 拒绝连接的原因, 用于统计
+var rejectReasons = map[error]string{
+	ErrServerFull:          "full",
+	ErrAcceptFiltered:      "filter",
+	ErrTooManyConnsPerIP:   "ip_limit",
+	ErrTooManyConnsPerCIDR: "cidr_limit",
+	ErrConnectRateExceeded: "rate",
+	ErrUntrustedProxy:      "untrusted_proxy",
+	ErrInvalidProxyHeader:  "proxy_header",
+}
+
+// rejectReason 返回拒绝连接原因的统计标签
+func rejectReason(err error) string {
+	if reason, ok := rejectReasons[err]; ok {
+		return reason
+	}
+	return "error"
+}
+
+// disconnectReason 返回断开原因的统计标签
+func disconnectReason(err error) string {
+	if reason, ok := disconnectReasons[err]; ok {
+		return reason
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return "timeout"
+	}
+	return "error"
+}
+
+// connStats 连接的统计数据, 服务器的连接同时累加到server
+type connStats struct {
+	connectedAt time.Time
+	bytesIn     uint64
+	bytesOut    uint64
+	packetsIn   uint64
+	packetsOut  uint64
+	dropped     uint64
+	recvDropped uint64
+
+	server *serverStats // 客户端的连接为nil
+}
+
+func (s *connStats) packetIn(n int) {
+	atomic.AddUint64(&s.bytesIn, uint64(n))
+	atomic.AddUint64(&s.packetsIn, 1)
+	if s.server != nil {
+		atomic.AddUint64(&s.server.bytesIn, uint64(n))
+		atomic.AddUint64(&s.server.packetsIn, 1)
+		s.server.sizeIn.observe(n)
+	}
+}
+
+func (s *connStats) packetOut(n int) {
+	atomic.AddUint64(&s.bytesOut, uint64(n))
+	atomic.AddUint64(&s.packetsOut, 1)
+	if s.server != nil {
+		atomic.AddUint64(&s.server.bytesOut, uint64(n))
+		atomic.AddUint64(&s.server.packetsOut, 1)
+		s.server.sizeOut.observe(n)
+	}
+}
+
+func (s *connStats) sendDropped() {
+	atomic.AddUint64(&s.dropped, 1)
+	if s.server != nil {
+		atomic.AddUint64(&s.server.dropped, 1)
+	}
+}
+
+func (s *connStats) receiveDropped() {
+	atomic.AddUint64(&s.recvDropped, 1)
+	if s.server != nil {
+		atomic.AddUint64(&s.server.recvDropped, 1)
+	}
+}
+
+func (s *connStats) disconnected(err error) {
+	if s.server != nil {
+		s.server.disconnects.add(disconnectReason(err))
+	}
+}
+
+func (s *connStats) snapshot() ConnectionStats {
+	return ConnectionStats{
+		ConnectedAt:    s.connectedAt,
+		BytesIn:        atomic.LoadUint64(&s.bytesIn),
+		BytesOut:       atomic.LoadUint64(&s.bytesOut),
+		PacketsIn:      atomic.LoadUint64(&s.packetsIn),
+		PacketsOut:     atomic.LoadUint64(&s.packetsOut),
+		SendDropped:    atomic.LoadUint64(&s.dropped),
+		ReceiveDropped: atomic.LoadUint64(&s.recvDropped),
+	}
+}
+
+// serverStats 服务器的统计数据
+type serverStats struct {
+	active      int64
+	accepted    uint64
+	bytesIn     uint64
+	bytesOut    uint64
+	packetsIn   uint64
+	packetsOut  uint64
+	dropped     uint64
+	recvDropped uint64
+
+	rejects     labeledCounter
+	disconnects labeledCounter
+	sizeIn      histogram
+	sizeOut     histogram
+}
+
+func (s *serverStats) rejected(reason string) {
+	s.rejects.add(reason)
+}
+
+func (s *serverStats) snapshot() ServerStats {
+	return ServerStats{
+		ActiveConnections: atomic.LoadInt64(&s.active),
+		Accepted:          atomic.LoadUint64(&s.accepted),
+		Rejected:          s.rejects.snapshot(),
+		Disconnects:       s.disconnects.snapshot(),
+		BytesIn:           atomic.LoadUint64(&s.bytesIn),
+		BytesOut:          atomic.LoadUint64(&s.bytesOut),
+		PacketsIn:         atomic.LoadUint64(&s.packetsIn),
+		PacketsOut:        atomic.LoadUint64(&s.packetsOut),
+		SendDropped:       atomic.LoadUint64(&s.dropped),
+		ReceiveDropped:    atomic.LoadUint64(&s.recvDropped),
+		PacketSizeIn:      s.sizeIn.snapshot(),
+		PacketSizeOut:     s.sizeOut.snapshot(),
+	}
+}
+
+// labeledCounter 按标签计数
+type labeledCounter struct {
+	mutex  sync.Mutex
+	counts map[string]uint64
+}
+
+func (c *labeledCounter) add(label string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[string]uint64)
+	}
+	c.counts[label]++
+}
+
+func (c *labeledCounter) snapshot() map[string]uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	m := make(map[string]uint64, len(c.counts))
+	for k, v := range c.counts {
+		m[k] = v
+	}
+	return m
+}
+
+// histogram 按packetSizeBuckets统计数据包大小, 最后一个桶为+Inf
+type histogram struct {
+	buckets [7]uint64
+	sum     uint64
+	count   uint64
+}
+
+func (h *histogram) observe(n int) {
+	i := sort.SearchInts(packetSizeBuckets, n)
+	atomic.AddUint64(&h.buckets[i], 1)
+	atomic.AddUint64(&h.sum, uint64(n))
+	atomic.AddUint64(&h.count, 1)
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{
+		Buckets: make([]uint64, len(packetSizeBuckets)+1),
+		Sum:     atomic.LoadUint64(&h.sum),
+		Count:   atomic.LoadUint64(&h.count),
+	}
+	var total uint64
+	for i := range s.Buckets {
+		total += atomic.LoadUint64(&h.buckets[i])
+		s.Buckets[i] = total
+	}
+	return s
+}
+
+// WritePrometheus 以Prometheus文本格式输出统计数据
+func (s ServerStats) WritePrometheus(w io.Writer) {
+	writeMetric(w, "rapidnet_connections_active", "gauge", "Number of active connections.", s.ActiveConnections)
+	writeMetric(w, "rapidnet_connections_accepted_total", "counter", "Total accepted connections.", s.Accepted)
+	writeLabeledMetric(w, "rapidnet_connections_rejected_total", "Total rejected connections by reason.", s.Rejected)
+	writeLabeledMetric(w, "rapidnet_disconnects_total", "Total disconnects by reason.", s.Disconnects)
+	writeMetric(w, "rapidnet_received_bytes_total", "counter", "Total bytes of received packets.", s.BytesIn)
+	writeMetric(w, "rapidnet_sent_bytes_total", "counter", "Total bytes of sent packets.", s.BytesOut)
+	writeMetric(w, "rapidnet_received_packets_total", "counter", "Total received packets.", s.PacketsIn)
+	writeMetric(w, "rapidnet_sent_packets_total", "counter", "Total sent packets.", s.PacketsOut)
+	writeMetric(w, "rapidnet_send_dropped_total", "counter", "Total packets dropped because the send queue was full.", s.SendDropped)
+	writeMetric(w, "rapidnet_receive_dropped_total", "counter", "Total received packets dropped by the rate limit.", s.ReceiveDropped)
+
+	fmt.Fprintln(w, "# HELP rapidnet_packet_size_bytes Size of packets.")
+	fmt.Fprintln(w, "# TYPE rapidnet_packet_size_bytes histogram")
+	writeHistogram(w, "rapidnet_packet_size_bytes", "in", s.PacketSizeIn)
+	writeHistogram(w, "rapidnet_packet_size_bytes", "out", s.PacketSizeOut)
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, value)
+}
+
+func writeLabeledMetric(w io.Writer, name, help string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+
+	reasons := make([]string, 0, len(values))
+	for reason := range values {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "%s{reason=%q} %d\n", name, reason, values[reason])
+	}
+}
+
+func writeHistogram(w io.Writer, name, direction string, h Histogram) {
+	for i, count := range h.Buckets {
+		le := "+Inf"
+		if i < len(packetSizeBuckets) {
+			le = strconv.Itoa(packetSizeBuckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{direction=%q,le=%q} %d\n", name, direction, le, count)
+	}
+	fmt.Fprintf(w, "%s_sum{direction=%q} %d\n", name, direction, h.Sum)
+	fmt.Fprintf(w, "%s_count{direction=%q} %d\n", name, direction, h.Count)
+}
@@ -0,0 +1,69 @@
+package rapidnet
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTCPServer_Stats(t *testing.T) {
+	server := CreateTCPServer()
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	clientConn, _, err := CreateTCPClient().Connect(server.Addr().String(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := waitEvent(t, serverEvents, EventConnected).Conn
+
+	clientConn.Send([]byte("hello"))
+	if data := <-conn.ReceiveDataChan(); string(data) != "hello" {
+		t.Fatal("unexpected data:", data)
+	}
+	conn.Send(make([]byte, 300))
+	<-clientConn.ReceiveDataChan()
+
+	stats := conn.Stats()
+	if stats.PacketsIn != 1 || stats.BytesIn != 5 || stats.PacketsOut != 1 || stats.BytesOut != 300 {
+		t.Fatalf("unexpected connection stats: %+v", stats)
+	}
+
+	s := server.Stats()
+	if s.ActiveConnections != 1 || s.Accepted != 1 {
+		t.Fatalf("unexpected server stats: %+v", s)
+	}
+	if s.PacketSizeIn.Buckets[0] != 1 || s.PacketSizeOut.Buckets[0] != 0 || s.PacketSizeOut.Buckets[2] != 1 {
+		t.Fatalf("unexpected histograms: %+v %+v", s.PacketSizeIn, s.PacketSizeOut)
+	}
+
+	clientConn.Disconnect()
+	waitEvent(t, serverEvents, EventDisconnected)
+	// 连接在通知断开后才从服务器中移除
+	for i := 0; i < 100 && server.Stats().ActiveConnections != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	s = server.Stats()
+	if s.ActiveConnections != 0 || s.Disconnects["eof"] != 1 {
+		t.Fatalf("unexpected server stats: %+v", s)
+	}
+
+	rec := httptest.NewRecorder()
+	server.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		"rapidnet_connections_active 0",
+		"rapidnet_connections_accepted_total 1",
+		`rapidnet_disconnects_total{reason="eof"} 1`,
+		"rapidnet_received_bytes_total 5",
+		`rapidnet_packet_size_bytes_bucket{direction="out",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, body)
+		}
+	}
+}
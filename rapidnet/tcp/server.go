@@ -9,6 +9,8 @@ import (
 	"runtime"
 	"sync"
 	"time"
+
+	"github.com/lzhig/rapidgo/rapidnet"
 )
 
 // maxInt64 is the effective "infinite" value for the Server and
@@ -46,6 +48,13 @@ type Server struct {
 	// ReadTimeout is the maximum duration for reading the entire
 	// request
 	ReadTimeout time.Duration
+
+	// ProxyProtocol, if non-nil, requires every accepted connection
+	// to start with a PROXY protocol (v1 or v2) header, read in the
+	// connection's goroutine with ProxyProtocol.Timeout. Connections
+	// from untrusted sources or with an invalid header are closed.
+	// Afterwards the connection's RemoteAddr reports the client.
+	ProxyProtocol *rapidnet.ProxyProtocol
 }
 
 func (s *Server) ListenAndServe() error {
@@ -182,6 +191,15 @@ type conn struct {
 
 // Serve a new connection.
 func (c *conn) serve() {
+	defer c.rwc.Close()
+	if p := c.server.ProxyProtocol; p != nil {
+		rwc, err := p.Accept(c.rwc)
+		if err != nil {
+			c.server.logf("http: proxy protocol from %v: %v", c.rwc.RemoteAddr(), err)
+			return
+		}
+		c.rwc = rwc
+	}
 	c.remoteAddr = c.rwc.RemoteAddr().String()
 	defer func() {
 		if err := recover(); err != nil && err != ErrAbortHandler {
@@ -193,12 +211,21 @@ func (c *conn) serve() {
 	}()
 
 	c.r = &connReader{conn: c}
+	c.r.setInfiniteReadLimit()
 	c.bufr = newBufioReader(c.r)
+	defer putBufioReader(c.bufr)
 	c.bufw = newBufioWriterSize(c.rwc, 4<<10)
+	defer putBufioWriter(c.bufw)
 
 	for {
-		c.rwc.SetReadDeadline(time.Now().Add(c.server.ReadTimeout))
-		c.bufr.Peek()
+		if d := c.server.ReadTimeout; d > 0 {
+			c.rwc.SetReadDeadline(time.Now().Add(d))
+		}
+		if _, err := c.bufr.Peek(1); err != nil {
+			return
+		}
+		// No Handler callbacks yet; discard what was read.
+		c.bufr.Discard(c.bufr.Buffered())
 	}
 }
 
@@ -0,0 +1,72 @@
+package tcp
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lzhig/rapidgo/rapidnet"
+)
+
+func TestServer_ProxyProtocol(t *testing.T) {
+	s := &Server{ProxyProtocol: &rapidnet.ProxyProtocol{Timeout: time.Second}}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		c1.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nhello"))
+		c1.Close()
+	}()
+
+	c := s.newConn(c2)
+	c.serve()
+	if c.remoteAddr != "192.168.0.1:56324" {
+		t.Fatal("unexpected remote address:", c.remoteAddr)
+	}
+}
+
+// logWriter 将每条日志发送到chan
+type logWriter chan string
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestServer_ProxyProtocolUntrusted(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	logs := make(logWriter, 1)
+	s := &Server{
+		ErrorLog:      log.New(logs, "", 0),
+		ProxyProtocol: &rapidnet.ProxyProtocol{TrustedNetworks: []*net.IPNet{trusted}},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.Serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"))
+
+	// 来源不可信, 服务器关闭连接
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("expect io.EOF, got", err)
+	}
+	select {
+	case msg := <-logs:
+		if !strings.HasPrefix(msg, "http: proxy protocol from ") || !strings.Contains(msg, rapidnet.ErrUntrustedProxy.Error()) {
+			t.Fatal("unexpected log:", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for log")
+	}
+}
@@ -0,0 +1,56 @@
+package udp
+
+import (
+	"net"
+
+	"github.com/lzhig/rapidgo/rapidnet"
+)
+
+// Client UDP客户端, 连接及事件与rapidnet.TCPClient相同.
+// UDP没有连接状态, 服务器不可达时可能不会断开, 需要通过Config.HeartbeatInterval检测.
+// 启用心跳还可以避免服务端因空闲超时断开连接
+type Client struct {
+	*rapidnet.TCPClient
+}
+
+// CreateClient 创建UDP客户端
+func CreateClient() *Client {
+	return CreateClientWithConfig(nil)
+}
+
+// CreateClientWithConfig 使用指定的配置创建UDP客户端.
+// cfg未指定PacketHandlerFactory时, 每个数据报对应一个数据包
+func CreateClientWithConfig(cfg *rapidnet.Config) *Client {
+	return &Client{TCPClient: rapidnet.CreateTCPClientWithConfig(withPacketHandler(cfg))}
+}
+
+// Connect 创建连接到address的socket, 不会与服务器交互.
+// 服务端收到第一个数据报后才建立连接
+func (c *Client) Connect(address string) (*rapidnet.Connection, <-chan *rapidnet.Event, error) {
+	pc, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c.TCPClient.ConnectConn(dialConn(pc.(*net.UDPConn)))
+}
+
+// dialConn 包装已连接的socket, 由单独的goroutine读取数据报, 关闭Conn时关闭socket
+func dialConn(pc *net.UDPConn) *Conn {
+	c := newConn(pc, pc.RemoteAddr(), true, func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := pc.Read(buf)
+			if err != nil {
+				c.closeWithError(err)
+				return
+			}
+			data := rapidnet.NewPacket(n)
+			copy(data, buf[:n])
+			c.push(data)
+		}
+	}()
+	return c
+}
@@ -0,0 +1,256 @@
+package udp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lzhig/rapidgo/rapidnet"
+)
+
+// maxDatagramSize UDP数据报的最大长度
+const maxDatagramSize = 65535
+
+// datagramQueueSize 每个Conn缓存的未读取的数据报数量, 超过时丢弃新收到的数据报
+const datagramQueueSize = 64
+
+var (
+	errClosed       = errors.New("udp: connection closed")
+	errWriteLimited = errors.New("udp: write exceeds bytes received")
+)
+
+// timeoutError 读超时, 实现了net.Error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "udp: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Conn 将与一个远端地址之间的UDP数据报包装为net.Conn.
+// Write发送一个数据报; Read将收到的数据报作为字节流读取.
+// 服务端的Conn共享监听的socket, 由Server按远端地址创建; 客户端的Conn独占一个已连接的socket.
+type Conn struct {
+	pc        net.PacketConn
+	addr      net.Addr // 远端地址
+	connected bool     // pc已连接到addr, 使用Write发送
+
+	dataChan chan []byte // 收到的数据报
+	reader   []byte      // 当前正在读取的数据报的剩余部分
+	current  rapidnet.Packet
+
+	lastReceiveTime int64 // 最后收到数据报的时间(UnixNano)
+	received        int64 // 收到的字节数
+	writeLimited    int32 // 不为0时写入受writeBudget限制
+	writeBudget     int64 // LimitWrites后还可以写入的字节数
+
+	deadlineMutex sync.Mutex
+	readDeadline  time.Time
+
+	closeChan chan struct{}
+	closeOnce sync.Once
+	err       error  // 关闭的原因, closeChan关闭后只读
+	onClose   func() // 关闭后调用
+}
+
+func newConn(pc net.PacketConn, addr net.Addr, connected bool, onClose func()) *Conn {
+	return &Conn{
+		pc:              pc,
+		addr:            addr,
+		connected:       connected,
+		dataChan:        make(chan []byte, datagramQueueSize),
+		lastReceiveTime: time.Now().UnixNano(),
+		closeChan:       make(chan struct{}),
+		onClose:         onClose,
+	}
+}
+
+// push 放入收到的数据报, 队列已满或已关闭时丢弃并返回false
+func (c *Conn) push(data []byte) bool {
+	atomic.StoreInt64(&c.lastReceiveTime, time.Now().UnixNano())
+	atomic.AddInt64(&c.received, int64(len(data)))
+
+	select {
+	case <-c.closeChan:
+	default:
+		select {
+		case c.dataChan <- data:
+			return true
+		default:
+		}
+	}
+	rapidnet.Packet(data).Release()
+	return false
+}
+
+// idle 返回距离最后收到数据报的时间
+func (c *Conn) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastReceiveTime)))
+}
+
+// ReadDatagram 读取一个完整的数据报, 不再使用时可以调用rapidnet.Packet(data).Release()归还缓冲区.
+// 等待期间修改读超时不会生效
+func (c *Conn) ReadDatagram() ([]byte, error) {
+	c.deadlineMutex.Lock()
+	deadline := c.readDeadline
+	c.deadlineMutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return nil, timeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case data := <-c.dataChan:
+		return data, nil
+	case <-c.closeChan:
+		return nil, c.err
+	case <-timeout:
+		return nil, timeoutError{}
+	}
+}
+
+// WriteDatagram 将data作为一个数据报发送
+func (c *Conn) WriteDatagram(data []byte) error {
+	_, err := c.Write(data)
+	return err
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.reader) == 0 {
+		c.current.Release()
+		c.current = nil
+
+		data, err := c.ReadDatagram()
+		if err != nil {
+			return 0, err
+		}
+		c.current = data
+		c.reader = data
+	}
+
+	n := copy(p, c.reader)
+	c.reader = c.reader[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closeChan:
+		return 0, c.err
+	default:
+	}
+
+	if atomic.LoadInt32(&c.writeLimited) != 0 && atomic.AddInt64(&c.writeBudget, -int64(len(p))) < 0 {
+		return 0, errWriteLimited
+	}
+
+	if c.connected {
+		return c.pc.(net.Conn).Write(p)
+	}
+	return c.pc.WriteTo(p, c.addr)
+}
+
+// LimitWrites 实现rapidnet.AmplificationLimiter, 之后写入的总字节数不能超过已收到的字节数.
+// 服务器拒绝连接时调用, 避免向伪造的源地址发送比收到的数据报更大的拒绝数据包
+func (c *Conn) LimitWrites() {
+	atomic.StoreInt64(&c.writeBudget, atomic.LoadInt64(&c.received))
+	atomic.StoreInt32(&c.writeLimited, 1)
+}
+
+// Close 关闭连接. 服务端的Conn关闭后, 再收到来自同一地址的数据报时创建新的Conn
+func (c *Conn) Close() error {
+	c.closeWithError(errClosed)
+	return nil
+}
+
+// closeWithError 以err关闭连接, 之后的读写返回err
+func (c *Conn) closeWithError(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.closeChan)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+}
+
+// LocalAddr function
+func (c *Conn) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+// RemoteAddr function
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline 只设置读超时, 参见SetWriteDeadline
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline function
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	c.readDeadline = t
+	c.deadlineMutex.Unlock()
+	return nil
+}
+
+// SetWriteDeadline 发送数据报不会长时间阻塞, 服务端的Conn共享socket, 因此忽略写超时
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// packetHandler 每个数据报对应一个数据包
+type packetHandler struct {
+	conn *Conn
+}
+
+// PacketHandlerFactory 每个数据报对应一个数据包, 只能用于*Conn.
+// 是Server及Client的默认PacketHandlerFactory.
+// 也可以使用流式的包处理器(例如rapidnet.LengthFieldPacketHandler), 此时一个数据报可以包含多个数据包,
+// 但数据包不能跨越数据报, 并且丢失的数据报会导致解析错误
+func PacketHandlerFactory(c net.Conn) rapidnet.PacketHandler {
+	return &packetHandler{conn: c.(*Conn)}
+}
+
+// Receive 阻塞直到收到一个数据报, 连接关闭或空闲超时时返回错误
+func (h *packetHandler) Receive() ([]byte, error) {
+	return h.conn.ReadDatagram()
+}
+
+// Send 立即发送一个数据报
+func (h *packetHandler) Send(data []byte) error {
+	return h.conn.WriteDatagram(data)
+}
+
+// Flush Send不缓存数据, 不需要flush
+func (h *packetHandler) Flush() error {
+	return nil
+}
+
+// PooledPackets 数据报从缓冲池中分配
+func (h *packetHandler) PooledPackets() bool {
+	return true
+}
+
+// withPacketHandler 未指定PacketHandlerFactory时使用数据报作为数据包
+func withPacketHandler(cfg *rapidnet.Config) *rapidnet.Config {
+	c := rapidnet.Config{}
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.PacketHandlerFactory == nil {
+		c.PacketHandlerFactory = PacketHandlerFactory
+	}
+	return &c
+}
@@ -0,0 +1,258 @@
+package udp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lzhig/rapidgo/rapidnet"
+)
+
+// DefaultIdleTimeout Server.IdleTimeout的默认值
+const DefaultIdleTimeout = 30 * time.Second
+
+// acceptBacklog 等待accept的新连接的数量, 超过时丢弃来自新地址的数据报
+const acceptBacklog = 128
+
+var errListenerClosed = errors.New("udp: listener closed")
+
+// Server UDP服务器.
+// 每个远端地址对应一个*rapidnet.Connection(伪连接), 收到来自新地址的第一个数据报时建立,
+// 超过IdleTimeout没有收到数据报时以rapidnet.ErrIdleTimeout断开. 事件与rapidnet.TCPServer相同,
+// 连接数上限、AcceptFilter、AcceptLimits等配置同样适用, 被拒绝的地址再次发送数据报时会重新检查.
+// 源地址可能是伪造的, ServerFullPacket编码后不超过收到的数据报长度时才发送.
+// 所有连接共享一个socket, Stop后不再建立新连接, 所有连接断开后关闭socket.
+type Server struct {
+	*rapidnet.TCPServer
+
+	// IdleTimeout 连接超过此时间没有收到数据报时断开, 为0时使用DefaultIdleTimeout. 需要在启动前设置
+	IdleTimeout time.Duration
+
+	listener *listener
+}
+
+// CreateServer 创建UDP服务器
+func CreateServer() *Server {
+	return CreateServerWithConfig(nil)
+}
+
+// CreateServerWithConfig 使用指定的配置创建UDP服务器.
+// cfg未指定PacketHandlerFactory时, 每个数据报对应一个数据包
+func CreateServerWithConfig(cfg *rapidnet.Config) *Server {
+	return &Server{TCPServer: rapidnet.CreateTCPServerWithConfig(withPacketHandler(cfg))}
+}
+
+// Start 在address上监听UDP
+func (s *Server) Start(address string, maxClientsAllowed uint32) (<-chan *rapidnet.Event, error) {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return s.Serve(pc, maxClientsAllowed)
+}
+
+// StartWithHandler 在address上监听UDP, 连接事件及收到的数据通过handler回调通知
+func (s *Server) StartWithHandler(address string, maxClientsAllowed uint32, handler rapidnet.Handler) error {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	return s.ServeWithHandler(pc, maxClientsAllowed, handler)
+}
+
+// Serve 在已有的socket上接收数据报
+func (s *Server) Serve(pc net.PacketConn, maxClientsAllowed uint32) (<-chan *rapidnet.Event, error) {
+	s.listener = newListener(pc, s.idleTimeout())
+	return s.TCPServer.Serve(s.listener, maxClientsAllowed)
+}
+
+// ServeWithHandler 在已有的socket上接收数据报, 连接事件及收到的数据通过handler回调通知
+func (s *Server) ServeWithHandler(pc net.PacketConn, maxClientsAllowed uint32, handler rapidnet.Handler) error {
+	s.listener = newListener(pc, s.idleTimeout())
+	return s.TCPServer.ServeWithHandler(s.listener, maxClientsAllowed, handler)
+}
+
+func (s *Server) idleTimeout() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+// listener 按远端地址分发数据报, 为新地址创建Conn并交给rapidnet.TCPServer
+type listener struct {
+	pc          net.PacketConn
+	idleTimeout time.Duration
+
+	connChan  chan *Conn
+	closeChan chan struct{}
+	doneChan  chan struct{} // 读取循环退出时关闭
+
+	mutex  sync.Mutex
+	conns  map[string]*Conn
+	closed bool // 不再创建新连接
+}
+
+func newListener(pc net.PacketConn, idleTimeout time.Duration) *listener {
+	l := &listener{
+		pc:          pc,
+		idleTimeout: idleTimeout,
+		connChan:    make(chan *Conn, acceptBacklog),
+		closeChan:   make(chan struct{}),
+		doneChan:    make(chan struct{}),
+		conns:       make(map[string]*Conn),
+	}
+	go l.readLoop()
+	go l.expireLoop()
+	return l
+}
+
+func (l *listener) readLoop() {
+	defer close(l.doneChan)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			l.Close()
+			l.closeAll(err)
+			return
+		}
+
+		data := rapidnet.NewPacket(n)
+		copy(data, buf[:n])
+		l.deliver(addr, data)
+	}
+}
+
+// expireLoop 定期断开空闲的连接
+func (l *listener) expireLoop() {
+	ticker := time.NewTicker(l.idleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, c := range l.list() {
+				if c.idle(now) > l.idleTimeout {
+					c.closeWithError(rapidnet.ErrIdleTimeout)
+				}
+			}
+		case <-l.doneChan:
+			return
+		}
+	}
+}
+
+// deliver 将数据报交给addr对应的连接, 不存在或已关闭(还未从conns中删除)时创建新连接,
+// 放入数据报后再等待accept, 拒绝连接时已收到的字节数是确定的. 已关闭或等待accept的连接过多时丢弃数据报
+func (l *listener) deliver(addr net.Addr, data []byte) {
+	key := addr.String()
+
+	l.mutex.Lock()
+	if c, ok := l.conns[key]; ok {
+		select {
+		case <-c.closeChan:
+		default:
+			l.mutex.Unlock()
+			c.push(data)
+			return
+		}
+	}
+	defer l.mutex.Unlock()
+
+	// 只有读取循环放入connChan, 检查后不会阻塞
+	if l.closed || len(l.connChan) == cap(l.connChan) {
+		rapidnet.Packet(data).Release()
+		return
+	}
+
+	var c *Conn
+	c = newConn(l.pc, addr, false, func() { l.remove(key, c) })
+	c.push(data)
+	l.conns[key] = c
+	l.connChan <- c
+}
+
+// remove 删除已关闭的连接, 不再创建新连接并且所有连接都已关闭时关闭socket
+func (l *listener) remove(key string, c *Conn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.conns[key] == c {
+		delete(l.conns, key)
+	}
+	if l.closed && len(l.conns) == 0 {
+		l.pc.Close()
+	}
+}
+
+func (l *listener) list() []*Conn {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	list := make([]*Conn, 0, len(l.conns))
+	for _, c := range l.conns {
+		list = append(list, c)
+	}
+	return list
+}
+
+// closeAll 以err关闭所有连接
+func (l *listener) closeAll(err error) {
+	for _, c := range l.list() {
+		c.closeWithError(err)
+	}
+}
+
+// Accept 返回下一个新连接, 跳过等待期间已空闲超时的连接
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		select {
+		case c := <-l.connChan:
+			select {
+			case <-c.closeChan:
+				continue
+			default:
+			}
+			return c, nil
+		case <-l.closeChan:
+			return nil, errListenerClosed
+		}
+	}
+}
+
+// Close 不再创建新连接, 已建立的连接不受影响. 所有连接关闭后关闭socket
+func (l *listener) Close() error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.closeChan)
+	l.mutex.Unlock()
+
+	// 关闭还没有accept的连接
+	for {
+		select {
+		case c := <-l.connChan:
+			c.Close()
+		default:
+			l.mutex.Lock()
+			if len(l.conns) == 0 {
+				l.pc.Close()
+			}
+			l.mutex.Unlock()
+			return nil
+		}
+	}
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
@@ -0,0 +1,149 @@
+package udp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lzhig/rapidgo/rapidnet"
+)
+
+func TestServer(t *testing.T) {
+	server := CreateServer()
+	server.IdleTimeout = 200 * time.Millisecond
+	serverEvents, err := server.Start("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := CreateClient()
+	conn, _, err := client.Connect(server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	conn.Send([]byte("hello"))
+	event := <-serverEvents
+	if event.Type != rapidnet.EventConnected {
+		t.Fatal("expect EventConnected, got", event.Type)
+	}
+	serverConn := event.Conn
+
+	conn.Send([]byte("world"))
+	for _, want := range []string{"hello", "world"} {
+		data := <-serverConn.ReceiveDataChan()
+		if string(data) != want {
+			t.Fatalf("got %q, want %q", data, want)
+		}
+		serverConn.Send(data)
+	}
+	for _, want := range []string{"hello", "world"} {
+		if data := <-conn.ReceiveDataChan(); string(data) != want {
+			t.Fatalf("got %q, want %q", data, want)
+		}
+	}
+
+	// 空闲超时后断开, 再次发送时建立新连接
+	event = <-serverEvents
+	if event.Type != rapidnet.EventDisconnected || event.Err != rapidnet.ErrIdleTimeout {
+		t.Fatal("expect EventDisconnected with ErrIdleTimeout, got", event.Type, event.Err)
+	}
+	conn.Send([]byte("again"))
+	event = <-serverEvents
+	if event.Type != rapidnet.EventConnected || event.Conn == serverConn {
+		t.Fatal("expect a new connection, got", event.Type)
+	}
+	if data := <-event.Conn.ReceiveDataChan(); string(data) != "again" {
+		t.Fatalf("got %q, want %q", data, "again")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go server.Shutdown(ctx)
+
+	event = <-serverEvents
+	if event.Type != rapidnet.EventDisconnected {
+		t.Fatal("expect EventDisconnected, got", event.Type)
+	}
+}
+
+func TestServer_LengthField(t *testing.T) {
+	cfg := &rapidnet.Config{PacketHandlerFactory: rapidnet.NewLengthFieldPacketHandlerFactory(rapidnet.DefaultLengthFieldSpec)}
+	server := CreateServerWithConfig(cfg)
+	serverEvents, err := server.Start("127.0.0.1:0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client := CreateClientWithConfig(cfg)
+	conn, _, err := client.Connect(server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	conn.Send([]byte("hello"))
+	conn.Send([]byte("world"))
+	event := <-serverEvents
+	if event.Type != rapidnet.EventConnected {
+		t.Fatal("expect EventConnected, got", event.Type)
+	}
+	for _, want := range []string{"hello", "world"} {
+		if data := <-event.Conn.ReceiveDataChan(); string(data) != want {
+			t.Fatalf("got %q, want %q", data, want)
+		}
+	}
+}
+
+func TestServer_ServerFullPacket(t *testing.T) {
+	full := bytes.Repeat([]byte("f"), 100)
+	server := CreateServerWithConfig(&rapidnet.Config{
+		RejectWhenFull:   true,
+		ServerFullPacket: func(addr net.Addr) []byte { return full },
+	})
+	serverEvents, err := server.Start("127.0.0.1:0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	c1, err := net.Dial("udp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c1.Write([]byte("hello"))
+	if event := <-serverEvents; event.Type != rapidnet.EventConnected {
+		t.Fatal("expect EventConnected, got", event.Type)
+	}
+
+	for _, tc := range []struct {
+		size int
+		sent bool
+	}{{10, false}, {len(full), true}} {
+		c, err := net.Dial("udp", server.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write(make([]byte, tc.size))
+		if event := <-serverEvents; event.Type != rapidnet.EventRejected || event.Err != rapidnet.ErrServerFull {
+			t.Fatal("expect EventRejected with ErrServerFull, got", event.Type, event.Err)
+		}
+
+		// 拒绝数据包比收到的数据报大时不发送
+		buf := make([]byte, 1024)
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := c.Read(buf)
+		if sent := err == nil; sent != tc.sent {
+			t.Fatalf("datagram of %d bytes: expect sent %v, got %v", tc.size, tc.sent, err)
+		}
+		if tc.sent && !bytes.Equal(buf[:n], full) {
+			t.Fatalf("got %q, want %q", buf[:n], full)
+		}
+	}
+}
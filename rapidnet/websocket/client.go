@@ -0,0 +1,44 @@
+package websocket
+
+import (
+	"net/http"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+
+	"github.com/lzhig/rapidgo/rapidnet"
+)
+
+// Client websocket客户端, 连接及事件与rapidnet.TCPClient相同
+type Client struct {
+	*rapidnet.TCPClient
+
+	// Header 握手时附加的http头
+	Header http.Header
+}
+
+// CreateClient 创建websocket客户端
+func CreateClient() *Client {
+	return CreateClientWithConfig(nil)
+}
+
+// CreateClientWithConfig 使用指定的配置创建websocket客户端.
+// cfg未指定PacketHandlerFactory时, 每个二进制消息对应一个数据包
+func CreateClientWithConfig(cfg *rapidnet.Config) *Client {
+	return &Client{TCPClient: rapidnet.CreateTCPClientWithConfig(withPacketHandler(cfg))}
+}
+
+// Connect 连接到url(ws://或wss://), timeout为握手超时的毫秒数
+func (c *Client) Connect(url string, timeout uint32) (*rapidnet.Connection, <-chan *rapidnet.Event, error) {
+	dialer := ws.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: time.Millisecond * time.Duration(timeout),
+	}
+
+	conn, _, err := dialer.Dial(url, c.Header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c.TCPClient.ConnectConn(NewConn(conn))
+}
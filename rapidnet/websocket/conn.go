@@ -0,0 +1,169 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+
+	"github.com/lzhig/rapidgo/rapidnet"
+)
+
+// ErrUnsupportedData 收到了二进制消息以外的消息
+var ErrUnsupportedData = errors.New("websocket: unsupported message type")
+
+// closeTimeout 发送关闭消息的超时时间
+const closeTimeout = time.Second
+
+// Conn 将websocket连接包装为net.Conn.
+// Write写入一个二进制消息; Read将收到的消息作为字节流读取.
+// 只接受二进制消息, 收到文本消息时以1003(CloseUnsupportedData)关闭连接, 读取返回ErrUnsupportedData
+type Conn struct {
+	ws     *ws.Conn
+	reader io.Reader // 当前正在读取的消息
+}
+
+// NewConn 包装websocket连接
+func NewConn(c *ws.Conn) *Conn {
+	return &Conn{ws: c}
+}
+
+// WebSocket 返回底层的websocket连接
+func (c *Conn) WebSocket() *ws.Conn {
+	return c.ws
+}
+
+// ReadMessage 读取一个完整的二进制消息
+func (c *Conn) ReadMessage() ([]byte, error) {
+	messageType, data, err := c.ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if messageType != ws.BinaryMessage {
+		return nil, c.closeWith(ws.CloseUnsupportedData, ErrUnsupportedData)
+	}
+	return data, nil
+}
+
+// WriteMessage 将data作为一个二进制消息写入
+func (c *Conn) WriteMessage(data []byte) error {
+	return c.ws.WriteMessage(ws.BinaryMessage, data)
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, r, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if messageType != ws.BinaryMessage {
+				return 0, c.closeWith(ws.CloseUnsupportedData, ErrUnsupportedData)
+			}
+			c.reader = r
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close 关闭底层连接
+func (c *Conn) Close() error {
+	return c.ws.Close()
+}
+
+// closeWith 发送关闭码为code的关闭消息后关闭连接, 返回err
+func (c *Conn) closeWith(code int, err error) error {
+	c.ws.WriteControl(ws.CloseMessage, ws.FormatCloseMessage(code, err.Error()), time.Now().Add(closeTimeout))
+	c.ws.Close()
+	return err
+}
+
+// LocalAddr function
+func (c *Conn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+// RemoteAddr function
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+// SetDeadline function
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+// SetReadDeadline function.
+// 注意: 读超时后websocket连接不能再使用
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+// SetWriteDeadline function
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// packetHandler 每个websocket消息对应一个数据包
+type packetHandler struct {
+	conn *Conn
+}
+
+// PacketHandlerFactory 每个websocket消息对应一个数据包, 只能用于*Conn.
+// 是Server及Client的默认PacketHandlerFactory.
+func PacketHandlerFactory(c net.Conn) rapidnet.PacketHandler {
+	return &packetHandler{conn: c.(*Conn)}
+}
+
+// Receive 阻塞直到收到一个消息. websocket读超时后连接不能再使用, 所以不设置读超时,
+// 断开连接时Receive返回错误
+func (h *packetHandler) Receive() ([]byte, error) {
+	return h.conn.ReadMessage()
+}
+
+// Send 立即发送一个消息
+func (h *packetHandler) Send(data []byte) error {
+	if err := h.conn.WriteMessage(data); err != nil {
+		h.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// Flush Send不缓存数据, 不需要flush
+func (h *packetHandler) Flush() error {
+	return nil
+}
+
+// withPacketHandler 未指定PacketHandlerFactory时使用websocket消息作为数据包
+func withPacketHandler(cfg *rapidnet.Config) *rapidnet.Config {
+	c := rapidnet.Config{}
+	if cfg != nil {
+		c = *cfg
+	}
+	if c.PacketHandlerFactory == nil {
+		c.PacketHandlerFactory = PacketHandlerFactory
+	}
+	return &c
+}
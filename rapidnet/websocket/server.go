@@ -1,7 +1,207 @@
 package websocket
 
 import (
-	ws "rapidgo/net/websocket/websocket"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+
+	"github.com/lzhig/rapidgo/rapidnet"
+)
+
+var (
+	errListenerClosed = errors.New("websocket: listener closed")
+	errAcceptTimeout  = errors.New("websocket: accept timeout")
 )
 
-var upgrader = ws.Upgrader{}
+// defaultAcceptTimeout 未设置Server.AcceptTimeout时使用
+const defaultAcceptTimeout = 5 * time.Second
+
+// Server websocket服务器.
+// 每个websocket连接对应一个*rapidnet.Connection, 事件与rapidnet.TCPServer相同.
+// Server实现了http.Handler, 可以挂载到已有的http服务上.
+type Server struct {
+	*rapidnet.TCPServer
+
+	// Upgrader 用于升级http请求, 可在启动前修改
+	Upgrader ws.Upgrader
+
+	// AcceptTimeout 连接数达到上限时(未设置RejectWhenFull), 升级后的连接等待被接受的最长时间,
+	// 超时后以1013(CloseTryAgainLater)关闭. 为0时使用5s. 设置RejectWhenFull时连接总是立即被接受或拒绝
+	AcceptTimeout time.Duration
+
+	listener   *listener
+	httpServer *http.Server
+}
+
+// CreateServer 创建websocket服务器
+func CreateServer() *Server {
+	return CreateServerWithConfig(nil)
+}
+
+// CreateServerWithConfig 使用指定的配置创建websocket服务器.
+// cfg未指定PacketHandlerFactory时, 每个二进制消息对应一个数据包
+func CreateServerWithConfig(cfg *rapidnet.Config) *Server {
+	return &Server{
+		TCPServer: rapidnet.CreateTCPServerWithConfig(withPacketHandler(cfg)),
+		Upgrader:  ws.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096},
+	}
+}
+
+// Start 在address上监听http, 所有路径的请求都升级为websocket连接
+func (s *Server) Start(address string, maxClientsAllowed uint32) (<-chan *rapidnet.Event, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s.listener = newListener(ln.Addr())
+	eventChan, err := s.TCPServer.Serve(s.listener, maxClientsAllowed)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	s.serveHTTP(ln)
+	return eventChan, nil
+}
+
+// StartWithHandler 在address上监听http, 连接事件及收到的数据通过handler回调通知
+func (s *Server) StartWithHandler(address string, maxClientsAllowed uint32, handler rapidnet.Handler) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	s.listener = newListener(ln.Addr())
+	if err := s.TCPServer.ServeWithHandler(s.listener, maxClientsAllowed, handler); err != nil {
+		ln.Close()
+		return err
+	}
+
+	s.serveHTTP(ln)
+	return nil
+}
+
+// Attach 启动服务器但不监听端口, 需要将Server作为http.Handler挂载到已有的http服务上,
+// 例如httptest.NewServer(s)
+func (s *Server) Attach(maxClientsAllowed uint32) (<-chan *rapidnet.Event, error) {
+	s.listener = newListener(&net.TCPAddr{})
+	return s.TCPServer.Serve(s.listener, maxClientsAllowed)
+}
+
+// AttachWithHandler 与Attach相同, 连接事件及收到的数据通过handler回调通知
+func (s *Server) AttachWithHandler(maxClientsAllowed uint32, handler rapidnet.Handler) error {
+	s.listener = newListener(&net.TCPAddr{})
+	return s.TCPServer.ServeWithHandler(s.listener, maxClientsAllowed, handler)
+}
+
+func (s *Server) serveHTTP(ln net.Listener) {
+	s.httpServer = &http.Server{Handler: s}
+	go s.httpServer.Serve(ln)
+}
+
+// ServeHTTP 将请求升级为websocket连接
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.listener == nil || s.listener.isClosed() {
+		http.Error(w, "server closed", http.StatusServiceUnavailable)
+		return
+	}
+
+	c, err := s.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade已经向客户端返回了错误
+		return
+	}
+
+	timeout := s.AcceptTimeout
+	if timeout <= 0 {
+		timeout = defaultAcceptTimeout
+	}
+	conn := NewConn(c)
+	switch s.listener.push(conn, timeout) {
+	case errListenerClosed:
+		conn.closeWith(ws.CloseGoingAway, errListenerClosed)
+	case errAcceptTimeout:
+		conn.closeWith(ws.CloseTryAgainLater, errAcceptTimeout)
+	}
+}
+
+// Stop 不再接受新连接, 已建立的连接不受影响
+func (s *Server) Stop() {
+	s.TCPServer.Stop()
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+}
+
+// Shutdown 优雅关闭服务器, 参见rapidnet.TCPServer.Shutdown
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.TCPServer.Shutdown(ctx)
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+	return err
+}
+
+// listener 将升级后的websocket连接交给rapidnet.TCPServer
+type listener struct {
+	addr      net.Addr
+	connChan  chan net.Conn
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func newListener(addr net.Addr) *listener {
+	return &listener{
+		addr:      addr,
+		connChan:  make(chan net.Conn),
+		closeChan: make(chan struct{}),
+	}
+}
+
+// push 等待Accept取走c, 最多等待timeout
+func (l *listener) push(c net.Conn, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case l.connChan <- c:
+		return nil
+	case <-l.closeChan:
+		return errListenerClosed
+	case <-timer.C:
+		return errAcceptTimeout
+	}
+}
+
+func (l *listener) isClosed() bool {
+	select {
+	case <-l.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connChan:
+		return c, nil
+	case <-l.closeChan:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() { close(l.closeChan) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
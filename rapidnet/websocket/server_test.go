@@ -0,0 +1,127 @@
+package websocket
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+
+	"github.com/lzhig/rapidgo/rapidnet"
+)
+
+func TestServer(t *testing.T) {
+	server := CreateServer()
+	serverEvents, err := server.Attach(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	client := CreateClient()
+	conn, clientEvents, err := client.Connect("ws"+strings.TrimPrefix(ts.URL, "http"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := <-serverEvents
+	if event.Type != rapidnet.EventConnected {
+		t.Fatal("expect EventConnected, got", event.Type)
+	}
+	serverConn := event.Conn
+
+	conn.Send([]byte("hello"))
+	conn.Send([]byte("world"))
+	for _, want := range []string{"hello", "world"} {
+		data := <-serverConn.ReceiveDataChan()
+		if string(data) != want {
+			t.Fatalf("got %q, want %q", data, want)
+		}
+		serverConn.Send(data)
+	}
+	for _, want := range []string{"hello", "world"} {
+		if data := <-conn.ReceiveDataChan(); string(data) != want {
+			t.Fatalf("got %q, want %q", data, want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go server.Shutdown(ctx)
+
+	event = <-serverEvents
+	if event.Type != rapidnet.EventDisconnected {
+		t.Fatal("expect EventDisconnected, got", event.Type)
+	}
+	for event := range clientEvents {
+		if event.Type == rapidnet.EventDisconnected {
+			break
+		}
+	}
+}
+
+func TestServer_TextMessage(t *testing.T) {
+	server := CreateServer()
+	serverEvents, err := server.Attach(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	defer server.Stop()
+
+	c, _, err := ws.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if event := <-serverEvents; event.Type != rapidnet.EventConnected {
+		t.Fatal("expect EventConnected, got", event.Type)
+	}
+
+	c.WriteMessage(ws.TextMessage, []byte("hello"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := c.ReadMessage(); !ws.IsCloseError(err, ws.CloseUnsupportedData) {
+		t.Fatal("expect close 1003, got", err)
+	}
+	event := <-serverEvents
+	if event.Type != rapidnet.EventDisconnected || event.Err != ErrUnsupportedData {
+		t.Fatal("expect EventDisconnected with ErrUnsupportedData, got", event.Type, event.Err)
+	}
+}
+
+func TestServer_AcceptTimeout(t *testing.T) {
+	server := CreateServer()
+	server.AcceptTimeout = 100 * time.Millisecond
+	serverEvents, err := server.Attach(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	defer server.Stop()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	c1, _, err := ws.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	if event := <-serverEvents; event.Type != rapidnet.EventConnected {
+		t.Fatal("expect EventConnected, got", event.Type)
+	}
+
+	// 连接数已达上限, 第二个连接等待AcceptTimeout后被关闭
+	c2, _, err := ws.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := c2.ReadMessage(); !ws.IsCloseError(err, ws.CloseTryAgainLater) {
+		t.Fatal("expect close 1013, got", err)
+	}
+}